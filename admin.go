@@ -1,11 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -20,6 +20,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/term"
@@ -35,11 +36,13 @@ type AdminTemplate struct {
 	ActiveTab string
 	AdminUrl  string
 	UserName  string
+	Role      string
+	CsrfToken string
 	CharSet   string
 }
 
-type post struct{ user string }
-type media struct{ user string }
+type post struct{ user, role string }
+type media struct{ user, role string }
 type creds struct{}
 type users struct{}
 type gitcl struct{}
@@ -47,23 +50,51 @@ type gitcl struct{}
 func handleAdmin(w http.ResponseWriter, r *http.Request) {
 	var err error
 	r.ParseMultipartForm(10 << 20)
+	if r.FormValue("logout") != "" {
+		// the token dies with the session so it's safe to pass in the logout link
+		if ss, ok := sessions.get(r); ok && subtle.ConstantTimeCompare([]byte(r.FormValue(csrfField)), []byte(ss.csrf)) != 1 {
+			log.Printf("Logout of %q from %q rejected: %v", ss.user, r.RemoteAddr, errCsrf)
+			http.Error(w, errCsrf.Error(), http.StatusForbidden)
+			return
+		}
+		sessions.logout(w, r)
+		http.Redirect(w, r, *adminUri, http.StatusSeeOther)
+		return
+	}
 	c := creds{}
 	user, ok := c.user(w, r)
 	if !ok {
 		return
 	}
-	log.Printf("admin user=%q from=%q uri=%q url=%q", user, r.RemoteAddr, r.RequestURI, r.URL.Path)
+	role := c.role(user)
+	log.Printf("admin user=%q role=%q from=%q uri=%q url=%q", user, role, clientIp(r), r.RequestURI, r.URL.Path)
 
 	adm := AdminTemplate{
-		SiteName: *siteName,
-		AdminUrl: *adminUri,
-		UserName: user,
-		CharSet:  charset[strings.HasPrefix(r.UserAgent(), "Mozilla/5")],
+		SiteName:  *siteName,
+		AdminUrl:  *adminUri,
+		UserName:  user,
+		Role:      role,
+		CsrfToken: sessions.csrfToken(r, user),
+		CharSet:   charset[strings.HasPrefix(r.UserAgent(), "Mozilla/5")],
+	}
+
+	if mutating(r) {
+		if err := checkCsrf(r, adm.CsrfToken); err != nil {
+			log.Printf("Rejected %q from %q: %v", user, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if _, ok := tabRole[r.FormValue("tab")]; ok && !tabAllowed(role, r.FormValue("tab")) {
+		log.Printf("Forbidden tab %q for %q (%v)", r.FormValue("tab"), user, role)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
 	switch r.FormValue("tab") {
 	case "posts", "":
-		m := post{user: user}
+		m := post{user: user, role: role}
 		adm.ActiveTab = "posts"
 		switch {
 		case r.FormValue("edit") != "":
@@ -74,15 +105,34 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 			adm.AdminTab, err = m.delete(r.FormValue("filename"))
 		case r.FormValue("newpost") != "":
 			adm.AdminTab, err = m.new(r.FormValue("newpost"))
+		case r.FormValue("create") != "":
+			adm.AdminTab, err = m.create(r.FormValue("create"))
 		case r.FormValue("save") != "":
-			adm.AdminTab, err = m.save(r.FormValue("filename"), r.FormValue("textdata"))
+			adm.AdminTab, err = m.save(r.FormValue("filename"), r.FormValue("base"), r.FormValue("textdata"))
+		case r.FormValue("preview") != "":
+			m.preview(w, r)
+			return
+		case r.FormValue("sharelink") != "":
+			adm.AdminTab, err = m.shareLink(r, r.FormValue("filename"))
+		case r.FormValue("publish") != "":
+			adm.AdminTab, err = m.publish(r.FormValue("filename"), true)
+		case r.FormValue("unpublish") != "":
+			adm.AdminTab, err = m.publish(r.FormValue("filename"), false)
+		case r.FormValue("history") != "":
+			adm.AdminTab, err = m.history(r.FormValue("filename"), "")
+		case r.FormValue("diff") != "":
+			adm.AdminTab, err = m.diff(r.FormValue("filename"), r.FormValue("from"), r.FormValue("to"))
+		case r.FormValue("revision") != "":
+			adm.AdminTab, err = m.revision(r.FormValue("filename"), r.FormValue("to"))
+		case r.FormValue("restore") == "true":
+			adm.AdminTab, err = m.restore(r.FormValue("filename"), r.FormValue("to"))
 		case r.FormValue("search") != "":
 			adm.AdminTab, err = m.list(r.FormValue("query"))
 		default:
 			adm.AdminTab, err = m.list("")
 		}
 	case "media":
-		m := media{user: user}
+		m := media{user: user, role: role}
 		adm.ActiveTab = "media"
 		switch {
 		case r.FormValue("rename") != "":
@@ -99,11 +149,48 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 		adm.ActiveTab = "users"
 		switch {
 		case r.FormValue("newuser") != "":
-			adm.AdminTab, err = m.newuser(r.FormValue("newuser"))
+			adm.AdminTab, err = m.newuser(r.FormValue("newuser"), r.FormValue("role"))
 		case r.FormValue("delete") == "true":
 			adm.AdminTab, err = m.delete(r.FormValue("username"))
 		case r.FormValue("passwd") != "":
 			adm.AdminTab, err = m.passwd(r.FormValue("username"), r.FormValue("passwd"))
+		case r.FormValue("setrole") != "":
+			adm.AdminTab, err = m.setrole(r.FormValue("username"), r.FormValue("role"))
+		case r.FormValue("revoke") != "":
+			adm.AdminTab, err = m.revoke(r.FormValue("username"))
+		case r.FormValue("totp") != "":
+			adm.AdminTab, err = m.totp(r.FormValue("username"), r.FormValue("totp"))
+		default:
+			adm.AdminTab, err = m.list("")
+		}
+	case "redirects":
+		m := redirs{user: user}
+		adm.ActiveTab = "redirects"
+		switch {
+		case r.FormValue("delete") == "true":
+			adm.AdminTab, err = m.delete(r.FormValue("filename"))
+		default:
+			adm.AdminTab, err = m.list("")
+		}
+	case "account":
+		m := account{user: user}
+		adm.ActiveTab = "account"
+		switch {
+		case r.FormValue("totp") != "":
+			adm.AdminTab, err = m.totp(r.FormValue("totp"))
+		case r.FormValue("verify") != "":
+			adm.AdminTab, err = m.verify(r.FormValue("otp"))
+		case r.FormValue("cancel") != "":
+			adm.AdminTab, err = m.cancel()
+		default:
+			adm.AdminTab, err = m.page("")
+		}
+	case "lockouts":
+		m := lockouts{}
+		adm.ActiveTab = "lockouts"
+		switch {
+		case r.FormValue("unlock") != "":
+			adm.AdminTab, err = m.unlock(r.FormValue("filename"))
 		default:
 			adm.AdminTab, err = m.list("")
 		}
@@ -114,6 +201,11 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 	default:
 		adm.AdminTab = "<H1>Not Implemented</H1><P>"
 	}
+	if errors.Is(err, errForbidden) {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -124,6 +216,20 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 	templates["admin"].Execute(w, adm)
 }
 
+// create asks to confirm creation of a new post, used by wiki links to missing pages
+func (p post) create(file string) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." {
+		return p.list("")
+	}
+	return `<H1>New Post</H1>
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="posts">
+	<INPUT TYPE="HIDDEN" NAME="newpost" VALUE="` + html.EscapeString(file) + `">
+	Post <B>` + html.EscapeString(file) + `</B> does not exist yet.<P>
+	<INPUT TYPE="SUBMIT" NAME="confirm" VALUE="Create">
+	`, nil
+}
+
 func (p post) new(file string) (string, error) {
 	file = unescapeOrEmpty(file)
 	if file == "" || file == "null" {
@@ -137,9 +243,13 @@ func (p post) new(file string) (string, error) {
 	if err == nil {
 		return "", fmt.Errorf("new post file %q already exists", file)
 	}
-	_, err = p.save(file,
+	title := "New Post!"
+	if *wikiMode {
+		title = wikiTitle(file)
+	}
+	_, err = p.save(file, "",
 		"<!--not-published=\""+time.Now().Format(timeFormat)+"\"-->\n"+
-			"<!--author=\""+p.user+"\"-->\n\n# New Post!\n\nHello world!\n\n")
+			"<!--author=\""+p.user+"\"-->\n\n# "+title+"\n\nHello world!\n\n")
 	if err != nil {
 		log.Printf("Unable to save post %q: %v", file, err)
 		return "", err
@@ -148,39 +258,106 @@ func (p post) new(file string) (string, error) {
 	return p.edit(file)
 }
 
-func (m post) save(file, postText string) (string, error) {
+// save writes the post, base is the revision the edit started from
+// if the file has been changed since, the save is refused and a conflict is shown
+func (m post) save(file, base, postText string) (string, error) {
 	file = unescapeOrEmpty(file)
 	if file == "" {
 		return m.list("")
 	}
-	fullFilename := path.Join(*rootDir, *postsDir, path.Base(file))
-	log.Printf("Saving %q", fullFilename)
+	err := m.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	err = m.mayPublish(postText)
+	if err != nil {
+		return "", err
+	}
 	if runtime.GOOS != "windows" {
 		postText = strings.ReplaceAll(postText, "\r\n", "\n")
 	}
+	postMu.Lock()
+	if cur := m.rev(file); base != "" && cur != base {
+		postMu.Unlock()
+		log.Printf("Edit conflict on %q by %v, base=%v current=%v", file, m.user, base, cur)
+		return m.conflict(file, postText)
+	}
+	err = m.write(file, postText, "User "+m.user+" modified "+path.Join(*postsDir, path.Base(file)))
+	postMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return m.list("")
+}
+
+// postMu is held from reading the current text of a post until the new text is written
+// so that two saves based on the same revision can't both pass the conflict check
+var postMu sync.Mutex
+
+// write stores the post, updates the indexes and commits it with the message, postMu must be held
+func (m post) write(file, postText, msg string) error {
+	fullFilename := path.Join(*rootDir, *postsDir, path.Base(file))
+	log.Printf("Saving %q", fullFilename)
 	err := os.WriteFile(fullFilename+".tmp", []byte(postText), 0644)
 	if err != nil {
-		return "", errors.New("unable to write temp file for %q: " + err.Error())
+		return errors.New("unable to write temp file for %q: " + err.Error())
 	}
 	st, err := os.Stat(fullFilename + ".tmp")
 	if err != nil {
-		return "", errors.New("unable to stat temp file for %q: " + err.Error())
+		return errors.New("unable to stat temp file for %q: " + err.Error())
 	}
 	if st.Size() != int64(len(postText)) {
-		return "", errors.New("temp file size != input size")
+		return errors.New("temp file size != input size")
 	}
 	err = os.Rename(fullFilename+".tmp", fullFilename)
 	if err != nil {
-		return "", errors.New("unable to rename temp file to the target file: " + err.Error())
+		return errors.New("unable to rename temp file to the target file: " + err.Error())
 	}
 	log.Printf("Saved post %q", file)
 	idx.update(file)
 	txt.update(file)
-	err = gitAdd(path.Join(*postsDir, path.Base(file)), m.user)
+	err = gitCommit(path.Join(*postsDir, path.Base(file)), m.user, msg)
 	if err != nil {
 		log.Printf("Unable git add %v: %v", file, err)
 	}
-	return m.list("")
+	return nil
+}
+
+// rev returns revision of the post on disk as a hash of its content
+// catches changes made outside of the admin too, empty if the post doesn't exist
+func (p post) rev(file string) string {
+	f, err := os.ReadFile(path.Join(*rootDir, *postsDir, path.Base(unescapeOrEmpty(file))))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(f))
+}
+
+// conflict shows changes made by someone else next to the rejected text
+// the text can be merged by hand and saved again against the current revision
+func (p post) conflict(file, postText string) (string, error) {
+	cur, err := os.ReadFile(path.Join(*rootDir, *postsDir, path.Base(file)))
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.New("unable to read " + file + " : " + err.Error())
+	}
+	buf := strings.Builder{}
+	buf.WriteString("<H1>Edit Conflict - " + html.EscapeString(file) + "</H1>\n" +
+		"<B>The post has been changed by someone else since you started editing. Your changes have not been saved.</B><P>\n" +
+		"Your version is below. Merge the changes and Save again to overwrite the current version, or Cancel to discard your changes.<P>\n" +
+		"<TEXTAREA NAME=\"textdata\" SPELLCHECK=\"true\" COLS=\"80\" ROWS=\"24\" WRAP=\"soft\" STYLE=\"width: 99%; height: 99%;\">\n" +
+		html.EscapeString(postText) + "</TEXTAREA><P>\n" +
+		"<INPUT TYPE=\"SUBMIT\" NAME=\"save\" VALUE=\"Save\"> <INPUT TYPE=\"SUBMIT\" NAME=\"cancel\" VALUE=\"Cancel\"><P>\n" +
+		"<INPUT TYPE=\"HIDDEN\" NAME=\"filename\" VALUE=\"" + html.EscapeString(file) + "\">\n" +
+		"<INPUT TYPE=\"HIDDEN\" NAME=\"base\" VALUE=\"" + p.rev(file) + "\">\n" +
+		"<INPUT TYPE=\"HIDDEN\" NAME=\"tab\" VALUE=\"posts\">\n" +
+		"<H2>Differences from the current version to yours</H2>\n" +
+		"<TABLE WIDTH=\"100%\" BGCOLOR=\"#FFFFFF\" CELLPADDING=\"10\" CELLSPACING=\"0\" BORDER=\"0\"><TR><TD><PRE>" +
+		renderDiff(lineDiff(string(cur), postText)) + "</PRE></TD></TR></TABLE>\n" +
+		"<H2>Current version</H2>\n" +
+		"<TABLE WIDTH=\"100%\" BGCOLOR=\"#FFFFFF\" CELLPADDING=\"10\" CELLSPACING=\"0\" BORDER=\"0\"><TR><TD><PRE>" +
+		html.EscapeString(string(cur)) + "</PRE></TD></TR></TABLE>\n",
+	)
+	return buf.String(), nil
 }
 
 func (p post) load(file string) (string, error) {
@@ -196,13 +373,21 @@ func (p post) delete(file string) (string, error) {
 	if file == "" {
 		return p.list("")
 	}
-	err := gitDelete(path.Join(*postsDir, file), p.user)
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	err = gitDelete(path.Join(*postsDir, file), p.user)
 	if err != nil {
 		log.Printf("Unable to git delete post %q : %v", file, err)
 		return "", err
 	}
 	idx.delete(file)
 	txt.delete(file)
+	err = redirects.dropTarget(file, p.user)
+	if err != nil {
+		log.Printf("Unable to drop redirects to %q: %v", file, err)
+	}
 	log.Printf("Deleted (%v) post %q", p.user, file)
 	return p.list("")
 }
@@ -217,13 +402,21 @@ func (p post) rename(old, new string) (string, error) {
 	if !strings.HasSuffix(new, ".md") {
 		new = new + ".md"
 	}
-	err := gitMove(path.Join(*postsDir, old), path.Join(*postsDir, new), p.user)
+	err := p.mayEdit(old)
+	if err != nil {
+		return "", err
+	}
+	err = gitMove(path.Join(*postsDir, old), path.Join(*postsDir, new), p.user)
 	if err != nil {
 		log.Printf("Unable to rename post from %q to %q: %v", old, new, err)
 		return "", err
 	}
 	idx.rename(old, new)
 	txt.rename(old, new)
+	err = redirects.add(old, new, p.user)
+	if err != nil {
+		log.Printf("Unable to add redirect from %q to %q: %v", old, new, err)
+	}
 	log.Printf("Renamed (%v) post %v to %v", p.user, old, new)
 	return p.list("")
 }
@@ -233,6 +426,10 @@ func (p post) edit(file string) (string, error) {
 	if file == "" {
 		return p.list("")
 	}
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
 	data, err := p.load(file)
 	if err != nil {
 		return "", errors.New("Unable to open " + file)
@@ -242,8 +439,10 @@ func (p post) edit(file string) (string, error) {
 		"</H1>\n" +
 		"<TEXTAREA NAME=\"textdata\" SPELLCHECK=\"true\" COLS=\"80\" ROWS=\"24\" WRAP=\"soft\" STYLE=\"width: 99%; height: 99%;\">\n" +
 		data + "</TEXTAREA><P>\n" +
-		"<INPUT TYPE=\"SUBMIT\" NAME=\"save\" VALUE=\"Save\"> <INPUT TYPE=\"SUBMIT\" NAME=\"cancel\" VALUE=\"Cancel\"><P>\n" +
+		"<INPUT TYPE=\"SUBMIT\" NAME=\"save\" VALUE=\"Save\"> <INPUT TYPE=\"SUBMIT\" NAME=\"cancel\" VALUE=\"Cancel\"> " +
+		"<INPUT TYPE=\"SUBMIT\" NAME=\"preview\" VALUE=\"Preview\" FORMTARGET=\"_blank\"><P>\n" +
 		"<INPUT TYPE=\"HIDDEN\" NAME=\"filename\" VALUE=\"" + html.EscapeString(file) + "\">\n" +
+		"<INPUT TYPE=\"HIDDEN\" NAME=\"base\" VALUE=\"" + p.rev(file) + "\">\n" +
 		"<INPUT TYPE=\"HIDDEN\" NAME=\"tab\" VALUE=\"posts\">\n",
 	)
 	return buf.String(), nil
@@ -259,6 +458,10 @@ func (post) list(query string) (string, error) {
 		<INPUT TYPE="SUBMIT" NAME="search" VALUE="Search">
 		<INPUT TYPE="SUBMIT" NAME="newpost" VALUE="New Post" ONCLICK="this.value=prompt('Name the new post:', 'new-post.md');">
 		<INPUT TYPE="SUBMIT" NAME="edit" VALUE="Edit">
+		<INPUT TYPE="SUBMIT" NAME="publish" VALUE="Publish">
+		<INPUT TYPE="SUBMIT" NAME="unpublish" VALUE="Unpublish">
+		<INPUT TYPE="SUBMIT" NAME="history" VALUE="History">
+		<INPUT TYPE="SUBMIT" NAME="sharelink" VALUE="Share Preview">
 		<INPUT TYPE="SUBMIT" NAME="rename" VALUE="Rename" ONCLICK="this.value=prompt('Enter new name:', '');">
 		<INPUT TYPE="SUBMIT" NAME="delete" VALUE="Delete" ONCLICK="this.value=confirm('Are you sure you want to delete this post?');">
 		<P>
@@ -294,13 +497,17 @@ func (post) list(query string) (string, error) {
 	i := 0
 	for _, a := range posts {
 		p := idx.metaData[a].published.Format(timeFormat)
-		if idx.metaData[a].published.IsZero() {
+		switch {
+		case idx.metaData[a].published.IsZero():
 			p = "draft"
+		case idx.metaData[a].scheduled():
+			p = "scheduled"
 		}
 		buf.WriteString("<TR BGCOLOR=\"" + bgf[i%2 == 0] + "\">" +
 			"<TD><INPUT TYPE=\"radio\" NAME=\"filename\" VALUE=\"" + a + "\">&nbsp;" +
 			"<A HREF=\"/" + url.QueryEscape(idx.metaData[a].url) + "\" TARGET=\"_blank\">" + html.EscapeString(a) + "</A></TD>" +
-			"<TD><A HREF=\"" + *adminUri + "/?tab=posts&edit=this&filename=" + url.QueryEscape(a) + "\">[Edit]</A></TD>" +
+			"<TD><A HREF=\"" + *adminUri + "/?tab=posts&edit=this&filename=" + url.QueryEscape(a) + "\">[Edit]</A> " +
+			"<A HREF=\"" + *adminUri + "/?tab=posts&history=this&filename=" + url.QueryEscape(a) + "\">[History]</A></TD>" +
 			"<TD>" + idx.metaData[a].author + "</TD>" +
 			"<TD>" + p + "</TD>" +
 			"<TD>" + idx.metaData[a].modified.Format(timeFormat) + "</TD></TR>\n")
@@ -312,6 +519,9 @@ func (post) list(query string) (string, error) {
 }
 
 func (m media) upload(r *http.Request) (string, error) {
+	if !atLeast(m.role, roleAuthor) {
+		return "", fmt.Errorf("%w: %v can't upload media", errForbidden, m.role)
+	}
 	i, h, err := r.FormFile("fileup")
 	if err != nil {
 		log.Printf("Unable to upload file %v", err)
@@ -345,6 +555,9 @@ func (m media) upload(r *http.Request) (string, error) {
 }
 
 func (m media) rename(old, new string) (string, error) {
+	if !atLeast(m.role, roleEditor) {
+		return "", fmt.Errorf("%w: %v can't rename media", errForbidden, m.role)
+	}
 	old = path.Base(unescapeOrEmpty(old))
 	new = path.Base(unescapeOrEmpty(new))
 	if old == "" || new == "" {
@@ -355,11 +568,15 @@ func (m media) rename(old, new string) (string, error) {
 		log.Printf("Unable to rename media from %q to %q: %v", old, new, err)
 		return "", err
 	}
+	dropVariants(old)
 	log.Printf("Renamed media %q to %q", old, new)
 	return m.list()
 }
 
 func (m media) delete(file string) (string, error) {
+	if !atLeast(m.role, roleEditor) {
+		return "", fmt.Errorf("%w: %v can't delete media", errForbidden, m.role)
+	}
 	file = path.Base(unescapeOrEmpty(file))
 	if file == "" {
 		return m.list()
@@ -369,6 +586,7 @@ func (m media) delete(file string) (string, error) {
 		log.Printf("Unable to delete media %q: %v", file, err)
 		return "", err
 	}
+	dropVariants(file)
 	log.Printf("Deleted media %q", file)
 	return m.list()
 }
@@ -405,7 +623,7 @@ func (media) list() (string, error) {
 		buf.WriteString(`
 			<TD BGCOLOR="#D0D0D0" ALIGN="center" VALIGN="bottom">
 			<A HREF="/media/` + un + `">
-			<IMG SRC="/media/` + un + `" BORDER="0" TITLE="` + nm + `" ALT="` + nm + `" WIDTH="150"></A><BR>
+			<IMG SRC="/media/` + un + `?w=150" BORDER="0" TITLE="` + nm + `" ALT="` + nm + `" WIDTH="150"></A><BR>
 			<INPUT TYPE="radio" NAME="filename" VALUE="` + un + `">
 			<A HREF="/media/` + un + `">` + nm + `</A></TD>
 		`)
@@ -440,10 +658,16 @@ func (g gitcl) list(msg string) (string, error) {
 	return buf.String(), nil
 }
 
-func (u users) newuser(usr string) (string, error) {
+func (u users) newuser(usr, role string) (string, error) {
 	if usr == "" {
 		return u.list("")
 	}
+	if role == "" {
+		role = roleAuthor
+	}
+	if !validRole(role) {
+		return "", fmt.Errorf("invalid role %q", role)
+	}
 	cr := creds{}
 	pwd := func(n int) string {
 		b := make([]byte, n)
@@ -455,7 +679,23 @@ func (u users) newuser(usr string) (string, error) {
 		log.Printf("unable to set password for %q:%v", usr, err)
 		return "", err
 	}
-	return u.list(html.EscapeString(fmt.Sprintf("User %q created. The password is: %q", usr, pwd)))
+	err = cr.setRole(usr, role)
+	if err != nil {
+		return "", err
+	}
+	return u.list(html.EscapeString(fmt.Sprintf("User %q created as %v. The password is: %q", usr, role, pwd)))
+}
+
+func (u users) setrole(user, role string) (string, error) {
+	if user == "" {
+		return u.list("")
+	}
+	cr := creds{}
+	err := cr.setRole(user, role)
+	if err != nil {
+		return "", err
+	}
+	return u.list("Changed role of user: " + html.EscapeString(user) + " to " + html.EscapeString(role))
 }
 
 func (u users) delete(usr string) (string, error) {
@@ -482,6 +722,31 @@ func (u users) passwd(user, password string) (string, error) {
 	return u.list("Changed password for user: " + html.EscapeString(user))
 }
 
+func (u users) totp(user, action string) (string, error) {
+	if user == "" {
+		return u.list("")
+	}
+	// users set up 2FA themselves in the Account tab, admins can only disable it, eg. for a lost phone
+	cr := creds{}
+	switch action {
+	case "true":
+		err := cr.totpDisable(user)
+		if err != nil {
+			return "", err
+		}
+		return u.list("Disabled 2FA for user: " + html.EscapeString(user))
+	}
+	return u.list("")
+}
+
+func (u users) revoke(user string) (string, error) {
+	if user == "" {
+		return u.list("")
+	}
+	n := sessions.revoke(user)
+	return u.list(fmt.Sprintf("Logged out %v session(s) of user: %v", n, html.EscapeString(user)))
+}
+
 func (u users) list(msg string) (string, error) {
 	if msg != "" {
 		msg = msg + "<P>\n"
@@ -492,19 +757,37 @@ func (u users) list(msg string) (string, error) {
 	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="users">
 	<INPUT TYPE="SUBMIT" NAME="newuser" VALUE="New User" ONCLICK="this.value=prompt('Name the new user:', '');">
 	<INPUT TYPE="SUBMIT" NAME="passwd" VALUE="Reset Password" ONCLICK="this.value=prompt('Enter new password:\nWARNING: the password will echo!', '');">
+	<INPUT TYPE="SUBMIT" NAME="revoke" VALUE="Log Out Sessions">
+	<INPUT TYPE="SUBMIT" NAME="totp" VALUE="Disable 2FA" ONCLICK="this.value=confirm('Are you sure you want to disable 2FA for this user?');">
 	<INPUT TYPE="SUBMIT" NAME="delete" VALUE="Delete" ONCLICK="this.value=confirm('Are you sure you want to delete this user?');">
+	<SELECT NAME="role">` + roleOptions(roleAuthor) + `</SELECT>
+	<INPUT TYPE="SUBMIT" NAME="setrole" VALUE="Set Role">
 	<P>
 	<TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="10" CELLSPACING="0" BORDER="0">
-	<TR ALIGN="LEFT"><TH>&nbsp;&nbsp;Username</TH><TH>Type</TH></TR>
+	<TR ALIGN="LEFT"><TH>&nbsp;&nbsp;Username</TH><TH>Type</TH><TH>2FA</TH><TH>Sessions</TH></TR>
 	`)
+	cr := creds{}
 	for i, u := range secretsStore.Keys() {
 		if !strings.HasPrefix(u, adminPrefix) {
 			continue
 		}
 		u = strings.Split(u, ":")[1]
+		us, err := cr.load(u)
+		if err != nil {
+			log.Printf("unable to load user %q: %v", u, err)
+			continue
+		}
+		tfa := "-"
+		if us.Totp != "" {
+			tfa = "enabled"
+		} else if us.TotpNew != "" {
+			tfa = "pending"
+		}
 		buf.WriteString("<TR BGCOLOR=\"" + bgf[i%2 == 0] + "\">" +
 			"<TD><INPUT TYPE=\"radio\" NAME=\"username\" VALUE=\"" + u + "\">&nbsp;" + html.EscapeString(u) + "</TD>" +
-			"<TD>admin</TD></TR>\n")
+			"<TD>" + us.role() + "</TD>" +
+			"<TD>" + tfa + "</TD>" +
+			"<TD>" + fmt.Sprint(sessions.count(u)) + "</TD></TR>\n")
 	}
 	buf.WriteString("</TR></TABLE>\n")
 	return buf.String(), nil
@@ -515,52 +798,182 @@ func (c creds) user(w http.ResponseWriter, r *http.Request) (string, bool) {
 		http.Error(w, "unable to get user db", http.StatusUnauthorized)
 		return "", false
 	}
-	u, p, ok := r.BasicAuth()
-	if ok && c.auth(u, p) {
+	if u, ok := sessions.user(r); ok {
 		return u, true
 	}
-	log.Printf("Unauthorized %q from %q", u, r.RemoteAddr)
-	w.Header().Set("WWW-Authenticate", "Basic realm=\"BloKi "+*siteName+"\"")
-	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	ip := clientIp(r)
+	if u, p, ok := r.BasicAuth(); ok && *httpAuth {
+		if lockedOut(w, ip, u) {
+			return "", false
+		}
+		if c.auth(u, p) {
+			// the password is right, so it's not a failed login, but basic auth can't carry the code
+			if c.hasTotp(u) {
+				log.Printf("Refused basic auth of %q from %q, 2FA is enabled", u, ip)
+				http.Error(w, "Users with two factor authentication must use the login form", http.StatusForbidden)
+				return "", false
+			}
+			logins.success(ip, u)
+			return u, true
+		}
+		logins.fail(ip, u)
+		log.Printf("Unauthorized %q from %q", u, ip)
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"BloKi "+*siteName+"\"")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if r.Method != http.MethodPost || r.FormValue("login") == "" {
+		c.login(w, r, http.StatusOK, "")
+		return "", false
+	}
+	u := r.FormValue("username")
+	if d := logins.locked(ip, u); d > 0 {
+		log.Printf("Locked out %q from %q for %v", u, ip, d.Round(time.Second))
+		w.Header().Set("Retry-After", fmt.Sprint(int(d.Seconds())+1))
+		c.login(w, r, http.StatusTooManyRequests, "Too many failed login attempts, try again in "+d.Round(time.Second).String()+".")
+		return "", false
+	}
+	if !c.auth(u, r.FormValue("password")) {
+		logins.fail(ip, u)
+		log.Printf("Unauthorized %q from %q", u, ip)
+		c.login(w, r, http.StatusUnauthorized, "Invalid username or password.")
+		return "", false
+	}
+	err := c.totpCheck(u, r.FormValue("otp"))
+	if err != nil {
+		logins.fail(ip, u)
+		log.Printf("Unauthorized %q from %q: %v", u, ip, err)
+		c.login(w, r, http.StatusUnauthorized, "Invalid two factor code.")
+		return "", false
+	}
+	logins.success(ip, u)
+	err = sessions.create(w, r, u)
+	if err != nil {
+		log.Printf("Unable to create session for %q: %v", u, err)
+		http.Error(w, "unable to create session", http.StatusInternalServerError)
+		return "", false
+	}
+	http.Redirect(w, r, *adminUri, http.StatusSeeOther)
 	return "", false
 }
 
-func (creds) auth(user, pass string) bool {
+// login renders the login form
+func (creds) login(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if msg != "" {
+		msg = "<B>" + html.EscapeString(msg) + "</B><P>\n"
+	}
+	adm := AdminTemplate{
+		SiteName:  *siteName,
+		AdminUrl:  *adminUri,
+		ActiveTab: "login",
+		CharSet:   charset[strings.HasPrefix(r.UserAgent(), "Mozilla/5")],
+		AdminTab: `<H1>Log In</H1>
+	` + msg + `
+	<TABLE BORDER="0" CELLPADDING="5">
+	<TR><TD>Username:</TD><TD><INPUT TYPE="TEXT" NAME="username" VALUE="` + html.EscapeString(r.FormValue("username")) + `"></TD></TR>
+	<TR><TD>Password:</TD><TD><INPUT TYPE="PASSWORD" NAME="password"></TD></TR>
+	<TR><TD>2FA Code:</TD><TD><INPUT TYPE="TEXT" NAME="otp" AUTOCOMPLETE="one-time-code"> (if enabled)</TD></TR>
+	<TR><TD>&nbsp;</TD><TD><INPUT TYPE="SUBMIT" NAME="login" VALUE="Log In"></TD></TR>
+	</TABLE>
+	`,
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(code)
+	templates["admin"].Execute(w, adm)
+}
+
+// userSecret is stored as json under the adminPrefix key in the secrets store
+// Kdf, Time, Memory and Threads record password hashing parameters, empty Kdf is legacy sha256
+type userSecret struct {
+	Salt     string
+	Hash     string
+	Role     string   `json:",omitempty"`
+	Kdf      string   `json:",omitempty"`
+	Time     uint32   `json:",omitempty"`
+	Memory   uint32   `json:",omitempty"`
+	Threads  uint8    `json:",omitempty"`
+	Totp     string   `json:",omitempty"`
+	TotpStep int64    `json:",omitempty"`
+	Recovery []string `json:",omitempty"`
+
+	// pending 2FA setup, active once confirmed with a code
+	TotpNew     string   `json:",omitempty"`
+	RecoveryNew []string `json:",omitempty"`
+}
+
+func (creds) load(user string) (userSecret, error) {
+	us := userSecret{}
+	if *secrets == "" || secretsStore == nil {
+		return us, errors.New("unable to access secret store")
+	}
 	jpwd, err := secretsStore.Get(context.TODO(), adminPrefix+user)
 	if err != nil {
-		return false
+		return us, err
+	}
+	err = json.Unmarshal(jpwd, &us)
+	return us, err
+}
+
+func (creds) store(user string, us userSecret) error {
+	if *secrets == "" || secretsStore == nil {
+		return errors.New("unable to access secret store")
+	}
+	spwd, err := json.Marshal(us)
+	if err != nil {
+		return err
 	}
-	spwd := struct{ Salt, Hash string }{}
-	err = json.Unmarshal(jpwd, &spwd)
+	return secretsStore.Put(context.TODO(), adminPrefix+user, spwd)
+}
+
+func (c creds) auth(user, pass string) bool {
+	spwd, err := c.load(user)
 	if err != nil {
+		// burn the same time as for existing users
+		spwd.hashPassword(pass, make([]byte, 16))
+		return false
+	}
+	if !spwd.checkPassword(pass) {
 		return false
 	}
-	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(spwd.Salt+pass)))
-	return subtle.ConstantTimeCompare([]byte(hash), []byte(spwd.Hash)) == 1
+	if spwd.Kdf != kdfArgon2id || spwd.Time != argonTime || spwd.Memory != argonMemory || spwd.Threads != argonThreads {
+		err = spwd.hashPassword(pass, nil)
+		if err == nil {
+			err = c.store(user, spwd)
+		}
+		if err != nil {
+			log.Printf("Unable to upgrade password hash for %q: %v", user, err)
+		} else {
+			log.Printf("Upgraded password hash for %q to %v", user, spwd.Kdf)
+		}
+	}
+	return true
 }
 
-func (creds) set(user, pass string) error {
+func (c creds) set(user, pass string) error {
 	if *secrets == "" || secretsStore == nil {
 		return errors.New("unable to access secret store")
 	}
-	buff := make([]byte, 8)
-	_, err := rand.Read(buff)
+	spwd, _ := c.load(user)
+	err := spwd.hashPassword(pass, nil)
 	if err != nil {
 		return err
 	}
-	salt := base64.StdEncoding.EncodeToString(buff)[:8]
-	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(salt+pass)))
-	spwd, err := json.Marshal(struct{ Salt, Hash string }{Salt: salt, Hash: hash})
+	err = c.store(user, spwd)
 	if err != nil {
 		return err
 	}
-	return secretsStore.Put(context.TODO(), adminPrefix+user, spwd)
+	sessions.revoke(user)
+	return nil
 }
 
-func (creds) del(user string) error {
+func (c creds) del(user string) error {
 	if *secrets == "" || secretsStore == nil {
 		return errors.New("unable to open user db")
 	}
+	if c.lastAdmin(user) {
+		return fmt.Errorf("%q is the last admin", user)
+	}
+	sessions.revoke(user)
 	return secretsStore.Delete(context.TODO(), adminPrefix+user)
 }
 
@@ -592,14 +1005,48 @@ func cliUserManager() {
 		if err != nil {
 			log.Fatal(err)
 		}
+	case "totp":
+		if flag.Arg(3) == "" {
+			log.Fatal("usage: bloki user totp <enable|disable> <username>")
+		}
+		switch flag.Arg(2) {
+		case "enable":
+			uri, codes, err := c.totpEnable(flag.Arg(3))
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Add to your authenticator app:\n%v\n\nRecovery codes:\n%v\n\nEnter code from the app: ", uri, strings.Join(codes, "\n"))
+			code, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			err = c.totpConfirm(flag.Arg(3), code)
+			if err != nil {
+				log.Fatalf("2FA not enabled: %v", err)
+			}
+			fmt.Println("2FA enabled")
+		case "disable":
+			err := c.totpDisable(flag.Arg(3))
+			if err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatal("usage: bloki user totp <enable|disable> <username>")
+		}
+	case "role":
+		if flag.Arg(3) == "" {
+			log.Fatal("usage: bloki user role <" + strings.Join(roles, "|") + "> <username>")
+		}
+		err := c.setRole(flag.Arg(3), flag.Arg(2))
+		if err != nil {
+			log.Fatal(err)
+		}
 	case "list":
 		for _, u := range secretsStore.Keys() {
 			if !strings.HasPrefix(u, adminPrefix) {
 				continue
 			}
-			fmt.Println(strings.Split(u, ":")[1])
+			u = strings.Split(u, ":")[1]
+			fmt.Println(u, c.role(u))
 		}
 	default:
-		fmt.Println("usage: bloki user <passwd|delete|list> [username]")
+		fmt.Println("usage: bloki user <passwd|delete|list|totp|role> [enable|disable|role] [username]")
 	}
 }
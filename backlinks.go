@@ -0,0 +1,115 @@
+// backlinks keep track of which posts link to a post ("What links here")
+// forward links are extracted by the indexer, the reverse map is rebuilt on every index change
+package main
+
+import (
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+var wikiLinkRe = regexp.MustCompile(`\[\[([^\]|\n]+)(?:\|[^\]\n]*)?\]\]`)
+
+const wikiPrefix = "wiki:"
+
+// linkTargets returns internal link targets found in post markdown
+// post urls are returned as is, wiki page names are prefixed with wikiPrefix
+func linkTargets(md []byte) []string {
+	tgt := []string{}
+	doc := parser.NewWithExtensions(parser.CommonExtensions | parser.Autolink).Parse(md)
+	ast.WalkFunc(doc, func(n ast.Node, entering bool) ast.WalkStatus {
+		l, ok := n.(*ast.Link)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		u, err := url.Parse(string(l.Destination))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || u.Path == "/" ||
+			strings.HasPrefix(u.Path, "/media/") ||
+			strings.HasPrefix(u.Path, "/tag/") ||
+			strings.HasPrefix(u.Path, *adminUri) {
+			return ast.GoToNext
+		}
+		tgt = append(tgt, unescapeOrEmpty(path.Base(u.Path)))
+		return ast.GoToNext
+	})
+	if *wikiMode {
+		for _, m := range wikiLinkRe.FindAllSubmatch(md, -1) {
+			tgt = append(tgt, wikiPrefix+strings.TrimSpace(string(m[1])))
+		}
+	}
+	return tgt
+}
+
+// resolve finds post file name for a link target, must be called with the index locked
+func (idx *postIndex) resolve(target string) (string, bool) {
+	if strings.HasPrefix(target, wikiPrefix) {
+		target = strings.TrimPrefix(target, wikiPrefix)
+		if f, ok := idx.titled(target); ok {
+			return f, true
+		}
+		target = strings.TrimSuffix(wikiFile(target), ".md")
+	}
+	if _, ok := idx.metaData[target+".md"]; ok {
+		return target + ".md", true
+	}
+	for f, m := range idx.metaData {
+		if m.url == url.QueryEscape(target) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// linkBack rebuilds the reverse link map, must be called with the index locked
+func (idx *postIndex) linkBack() {
+	idx.backLinks = make(map[string][]string)
+	for src, m := range idx.metaData {
+		seen := map[string]bool{}
+		for _, t := range m.links {
+			dst, ok := idx.resolve(t)
+			if !ok || dst == src || seen[dst] {
+				continue
+			}
+			seen[dst] = true
+			idx.backLinks[dst] = append(idx.backLinks[dst], src)
+		}
+	}
+}
+
+// referencedBy renders the list of visible posts linking to the post, as text if refs are set
+func (idx *postIndex) referencedBy(file string, refs *textRefs) string {
+	idx.RLock()
+	defer idx.RUnlock()
+	src := []string{}
+	for _, s := range idx.backLinks[file] {
+		if !idx.metaData[s].visible() {
+			continue
+		}
+		src = append(src, s)
+	}
+	if len(src) == 0 {
+		return ""
+	}
+	sort.Slice(src, func(i, j int) bool {
+		return strings.ToLower(idx.metaData[src[i]].title) < strings.ToLower(idx.metaData[src[j]].title)
+	})
+	buf := strings.Builder{}
+	if refs != nil {
+		buf.WriteString("Referenced by:\n")
+		for _, s := range src {
+			buf.WriteString("  " + idx.metaData[s].title + " " + refs.ref("/"+idx.metaData[s].url) + "\n")
+		}
+		return buf.String() + "\n"
+	}
+	buf.WriteString("<p>Referenced by:</p>\n")
+	for _, s := range src {
+		buf.WriteString("&raquo; <a href=\"/" + idx.metaData[s].url + "\">" + html.EscapeString(idx.metaData[s].title) + "</a><br>\n")
+	}
+	return buf.String()
+}
@@ -6,7 +6,7 @@ import (
 	"embed"
 	"flag"
 	"fmt"
-	"io"
+	"html"
 	"log"
 	"net"
 	"net/http"
@@ -29,22 +29,45 @@ var (
 	subTitle = flag.String("subtitle", "Blog about awesome things!", "Subtitle")
 	artPerPg = flag.Int("articles_per_page", 5, "number of articles per page")
 	ltsPosts = flag.Int("latest_posts", 15, "number of latests posts on the side")
+	siteUrl  = flag.String("site_url", "", "public url of the site used in feeds, eg. https://blog.mysite.net, derived from request if empty")
+	feedLen  = flag.Int("feed_posts", 15, "number of latest posts in rss/atom/json feeds")
+	feedFull = flag.Bool("feed_full", false, "include full posts in feeds, ignoring the more tag")
 	adminUri = flag.String("admin_uri", "/bk-admin/", "address of the admin interface")
 	rootDir  = flag.String("root_dir", "site/", "directory where site data is stored")
 	postsDir = flag.String("posts_subdir", "posts/", "directory holding user posts, relative to root dir")
 	mediaDir = flag.String("media_subdir", "media/", "directory holding user media, relative to root dir")
 	htmplDir = flag.String("template_subdir", "templates/", "directory holding html templates, relative to root dir")
+	cacheDir = flag.String("cache_subdir", ".cache/", "directory holding resized images, relative to root dir")
 	chroot   = flag.Bool("chroot", false, "chroot to root dir, requires root")
 	secrets  = flag.String("secrets", "", "location of secrets file, outside of chroot/site dir")
 	suidUser = flag.String("setuid", "", "Username or uid:gid pair, to setuid to if started as root")
 	bindAddr = flag.String("addr", ":8080", "listener address, eg. :8080 or :443")
 	fastCgi  = flag.Bool("fastcgi", false, "enable FastCGI mode")
 	useGit   = flag.Bool("use_git", true, "use git repo, enabled by default")
+	gophAddr = flag.String("gopher_addr", "", "gopher server listen address, eg. :70, disabled if empty")
 	acmBind  = flag.String("acm_addr", "", "autocert manager listen address, eg: :80")
+	sessIdle = flag.Duration("session_idle", 30*time.Minute, "admin session idle timeout")
+	sessLife = flag.Duration("session_max", 12*time.Hour, "admin session absolute timeout")
+	httpAuth = flag.Bool("basic_auth", false, "allow http basic auth for admin, eg. for scripts")
+	wikiMode = flag.Bool("wiki", false, "wiki mode, enables [[WikiLinks]] and orders pages by title instead of date")
+	imgSizes = flag.String("image_sizes", "150,320,640,1024,1600", "comma separated widths of resized image variants")
+	lgcWidth = flag.Int("legacy_image_width", 640, "max image width for legacy browsers, images are re-encoded as baseline jpeg or gif, 0 disables")
+	vntWidth = flag.Int("vintage_image_width", 480, "max image width for vintage browsers, images are re-encoded as web safe gif, 0 disables")
+	imgWidth = flag.Int("image_width", 640, "width of images in posts, larger images are served resized, 0 disables")
+	charSets = flag.String("charsets", "modern=UTF-8,legacy=ISO-8859-1,vintage=ISO-8859-1", "charset per client class, pages are transcoded to it, eg. vintage=windows-1250")
+	txtWidth = flag.Int("text_width", 72, "line width of text mode pages and gopher posts")
+	prevTtl  = flag.Duration("preview_ttl", 72*time.Hour, "validity of secret draft preview links")
+	loginMax = flag.Int("login_fails", 5, "failed admin logins per ip or user before lockout, 0 disables lockouts")
+	lockTime = flag.Duration("lockout", time.Minute, "initial lockout time, doubles with every further failed login")
+	lockMax  = flag.Duration("lockout_max", 24*time.Hour, "maximum lockout time, failures are forgotten after this long")
+	fail2ban = flag.Bool("fail2ban", false, "log failed logins in a fail2ban friendly format")
+	proxyIps = flag.String("trusted_proxies", "", "comma separated ips or cidrs of reverse proxies trusted to set client ip header")
+	ipHeader = flag.String("client_ip_header", "X-Forwarded-For", "header with client ip set by trusted proxies, eg. X-Real-IP")
 	acmWhLst multiString
 )
 
 var (
+	// admin pages are not transcoded, legacy browsers get latin1 which passes utf-8 form data through unchanged
 	charset = map[bool]string{
 		true:  "UTF-8",
 		false: "ISO-8859-1",
@@ -53,24 +76,47 @@ var (
 	//go:embed favicon.ico
 	favIcon []byte
 
-	//go:embed templates/admin.html templates/modern.html templates/legacy.html templates/vintage.html
+	robotsTxt []byte
+
+	//go:embed templates/admin.html templates/modern.html templates/legacy.html templates/vintage.html templates/error.html templates/text.txt
 	templateFS embed.FS
 
 	templates    map[string]*template.Template
 	idx          postIndex
 	txt          textSearch
+	redirects    redirectMap
+	sessions     sessionStore
+	logins       loginThrottle
 	secretsStore *tkvs.TKVS
 )
 
 func handleMedia(w http.ResponseWriter, r *http.Request) {
-	f, err := os.ReadFile(filepath.Join(*rootDir, *mediaDir, path.Base(unescapeOrEmpty(r.URL.Path))))
+	file := path.Base(unescapeOrEmpty(r.URL.Path))
+	if strings.HasPrefix(file, ".") {
+		renderErrorPage(w, r, http.StatusForbidden, "Access to "+html.EscapeString(r.URL.Path)+" is forbidden.")
+		return
+	}
+	v := widthVariant(atoiOrZero(r.FormValue("w")))
+	if c := vintage(r.UserAgent()); c != "modern" {
+		v = clientVariant(c, atoiOrZero(r.FormValue("w")))
+	}
+	fn, err := mediaVariant(file, v)
+	if err != nil {
+		log.Printf("unable to resize %q: %v", file, err)
+		fn = filepath.Join(*rootDir, *mediaDir, file)
+	}
+	f, err := os.ReadFile(fn)
 	if err != nil {
-		w.Header().Set("Content-Type", "text/plain")
-		io.WriteString(w, "error")
 		log.Print(err.Error())
+		if os.IsNotExist(err) {
+			renderErrorPage(w, r, http.StatusNotFound, "The file "+html.EscapeString(r.URL.Path)+" was not found.")
+			return
+		}
+		renderErrorPage(w, r, http.StatusInternalServerError, "Unable to read "+html.EscapeString(r.URL.Path)+".")
 		return
 	}
 	w.Header().Set("Content-Type", http.DetectContentType(f))
+	w.Header().Set("Vary", "User-Agent")
 	w.Write(f)
 }
 
@@ -81,7 +127,11 @@ func handleFavicon(w http.ResponseWriter, r *http.Request) {
 
 func handleRobots(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprint(w, "User-agent: *\nAllow: /\n")
+	if robotsTxt != nil {
+		w.Write(robotsTxt)
+		return
+	}
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\nDisallow: /*?pg=\nDisallow: /*?query=\nDisallow: %v\n\nSitemap: %v/sitemap.xml\n", *adminUri, baseUrl(r))
 }
 
 func vintage(ua string) string {
@@ -90,6 +140,8 @@ func vintage(ua string) string {
 		return "modern"
 	case strings.HasPrefix(ua, "Mozilla/4"):
 		return "legacy"
+	case textBrowser(ua):
+		return "text"
 	default:
 		return "vintage"
 	}
@@ -145,6 +197,10 @@ func main() {
 	http.HandleFunc("/media/", handleMedia)
 	http.HandleFunc(*adminUri, handleAdmin)
 	http.HandleFunc("/robots.txt", handleRobots)
+	http.HandleFunc("/sitemap.xml", handleSitemap)
+	http.HandleFunc("/feed.xml", handleRss)
+	http.HandleFunc("/atom.xml", handleAtom)
+	http.HandleFunc("/feed.json", handleJsonFeed)
 	http.HandleFunc("/favicon.ico", handleFavicon)
 
 	// open secrets before chroot
@@ -162,6 +218,11 @@ func main() {
 		return
 	}
 
+	err = checkCharsets()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// find uid/gid for setuid before chroot
 	suid, sgid := getSuidSgid()
 
@@ -192,6 +253,16 @@ func main() {
 		}()
 	}
 
+	// gopher listener
+	var gl net.Listener
+	if *gophAddr != "" {
+		gl, err = net.Listen("tcp", *gophAddr)
+		if err != nil {
+			log.Fatalf("unable to listen on %v: %v", *gophAddr, err)
+		}
+		log.Printf("Gopher listening on %q", *gophAddr)
+	}
+
 	// setuid now
 	setUidGid(suid, sgid)
 
@@ -219,7 +290,7 @@ func main() {
 		idx.rescan()
 		txt.rescan()
 		po := post{user: "bloki"}
-		_, err = po.save("my-first-post.md",
+		_, err = po.save("my-first-post.md", "",
 			"<!--published=\""+time.Now().Format(timeFormat)+"\"-->\n\n"+
 				"# My first blog post!\n\nHello World!\n\n")
 		if err != nil {
@@ -239,14 +310,15 @@ func main() {
 	}
 
 	// load templates
-	for _, t := range []string{"vintage", "legacy", "modern", "admin"} {
-		tpl, err := template.ParseFiles(path.Join(*rootDir, *htmplDir, t+".html"))
+	for _, f := range []string{"vintage.html", "legacy.html", "modern.html", "admin.html", "error.html", "text.txt"} {
+		t := strings.TrimSuffix(f, path.Ext(f))
+		tpl, err := template.ParseFiles(path.Join(*rootDir, *htmplDir, f))
 		switch err {
 		case nil:
 			templates[t] = tpl
 			log.Printf("Loaded local template %q from disk", t)
 		default:
-			templates[t], err = template.ParseFS(templateFS, *htmplDir+t+".html")
+			templates[t], err = template.ParseFS(templateFS, *htmplDir+f)
 			if err != nil {
 				log.Fatalf("error parsing embedded template %q: %v", t, err)
 			}
@@ -256,6 +328,10 @@ func main() {
 
 	// index articles
 	idx.rescan()
+	go idx.schedule()
+
+	// load redirects of renamed posts
+	redirects.load()
 
 	// start text search
 	txt.rescan()
@@ -270,6 +346,22 @@ func main() {
 		}
 	}
 
+	// robots.txt
+	rst, err := os.Stat(path.Join(*rootDir, "robots.txt"))
+	if err == nil && !rst.IsDir() {
+		f, err := os.ReadFile(path.Join(*rootDir, "robots.txt"))
+		if err == nil {
+			robotsTxt = f
+			log.Print("Loaded local robots.txt")
+		}
+	}
+
+	// gopher server
+	if gl != nil {
+		log.Print("Starting Gopher Server")
+		go serveGopher(gl)
+	}
+
 	// http(s) bind stuff
 	switch {
 	case *acmBind != "" && *secrets != "" && len(acmWhLst) > 0:
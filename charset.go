@@ -0,0 +1,120 @@
+// charset transcodes rendered pages for clients which don't understand UTF-8
+// typographic punctuation falls back to ascii, other unmappable characters to html entities
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+var asciiFallback = map[rune]string{
+	'\u2018': "'", '\u2019': "'", '\u201a': ",", '\u201b': "'",
+	'\u201c': "\"", '\u201d': "\"", '\u201e': "\"", '\u201f': "\"",
+	'\u2032': "'", '\u2033': "\"", '\u2039': "<", '\u203a': ">",
+	'\u2010': "-", '\u2011': "-", '\u2012': "-", '\u2013': "-", '\u2014': "--", '\u2015': "--",
+	'\u2026': "...", '\u2022': "*", '\u00ab': "<<", '\u00bb': ">>",
+	'\u2122': "(TM)", '\u00a9': "(C)", '\u00ae': "(R)", '\u20ac': "EUR",
+	'\u2190': "<-", '\u2192': "->", '\u2194': "<->", '\u00d7': "x",
+	'\u2002': " ", '\u2003': " ", '\u2009': " ", '\u202f': " ", '\u200b': "",
+}
+
+// charsetEncoder is a configured charset with replacements of typographic characters it lacks
+type charsetEncoder struct {
+	enc      encoding.Encoding
+	fallback *strings.Replacer
+}
+
+// charsetEncoders holds charsets of -charsets, filled by checkCharsets at startup and only read after
+var charsetEncoders = map[string]charsetEncoder{}
+
+// clientCharset returns the charset configured with -charsets for the client class
+func clientCharset(r *http.Request) string {
+	cl := vintage(r.UserAgent())
+	for _, c := range strings.Split(*charSets, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(c), "=")
+		if ok && k == cl && v != "" {
+			return v
+		}
+	}
+	return "UTF-8"
+}
+
+// checkCharsets validates -charsets, ianaindex knows names of some charsets it has no encoder for, eg. UTF-7
+func checkCharsets() error {
+	for _, c := range strings.Split(*charSets, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(c), "=")
+		if !ok || v == "" {
+			return fmt.Errorf("invalid charset %q, expected class=charset", c)
+		}
+		switch k {
+		case "modern", "legacy", "vintage", "text":
+		default:
+			return fmt.Errorf("unknown client class %q in charset %q", k, c)
+		}
+		if strings.EqualFold(v, "UTF-8") {
+			continue
+		}
+		enc, err := ianaindex.IANA.Encoding(v)
+		if err != nil {
+			return fmt.Errorf("charset %q: %v", v, err)
+		}
+		if enc == nil {
+			return fmt.Errorf("charset %q is not supported", v)
+		}
+		rep := []string{}
+		for r, a := range asciiFallback {
+			if _, err := enc.NewEncoder().String(string(r)); err != nil {
+				rep = append(rep, string(r), a)
+			}
+		}
+		charsetEncoders[v] = charsetEncoder{enc: enc, fallback: strings.NewReplacer(rep...)}
+	}
+	return nil
+}
+
+// transcode converts an UTF-8 page to the charset, unmappable characters in text pages become ?
+func transcode(page []byte, cs string, text bool) ([]byte, error) {
+	if strings.EqualFold(cs, "UTF-8") {
+		return page, nil
+	}
+	ce, ok := charsetEncoders[cs]
+	if !ok {
+		return nil, fmt.Errorf("charset %q is not configured", cs)
+	}
+	page = []byte(ce.fallback.Replace(string(page)))
+	if text {
+		page, err := encoding.ReplaceUnsupported(ce.enc.NewEncoder()).Bytes(page)
+		return bytes.ReplaceAll(page, []byte("\x1a"), []byte("?")), err
+	}
+	return encoding.HTMLEscapeUnsupported(ce.enc.NewEncoder()).Bytes(page)
+}
+
+// renderPage executes the template and writes it in the client charset
+// text pages get navigation and link references added
+func renderPage(w http.ResponseWriter, r *http.Request, code int, tmpl string, td TemplateData) {
+	ct := "text/html"
+	if tmpl == "text" {
+		ct = "text/plain"
+		td.textPager()
+	}
+	buf := bytes.Buffer{}
+	err := templates[tmpl].Execute(&buf, td)
+	if err != nil {
+		log.Print(err.Error())
+		buf.WriteString(err.Error())
+	}
+	page, err := transcode(buf.Bytes(), td.CharSet, tmpl == "text")
+	if err != nil {
+		log.Printf("unable to transcode to %v: %v", td.CharSet, err)
+		page, td.CharSet = buf.Bytes(), "UTF-8"
+	}
+	w.Header().Set("Content-Type", ct+"; charset="+td.CharSet)
+	w.WriteHeader(code)
+	w.Write(page)
+}
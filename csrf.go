@@ -0,0 +1,61 @@
+// csrf tokens protect admin actions from requests forged by other sites
+// every session has its own random token which must be posted back with the admin form
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+const csrfField = "csrf_token"
+
+var (
+	errCsrf = errors.New("invalid or missing CSRF token, please reload the admin page and try again")
+	errPost = errors.New("this action requires a POST request, please use the admin form")
+
+	// form values which trigger state changing actions or carry post text, per admin tab
+	mutations = map[string][]string{
+		"posts":     {"newpost", "save", "rename", "delete", "restore", "publish", "unpublish", "textdata"},
+		"":          {"newpost", "save", "rename", "delete", "restore", "publish", "unpublish", "textdata"},
+		"media":     {"upload", "rename", "delete"},
+		"users":     {"newuser", "delete", "passwd", "setrole", "revoke", "totp"},
+		"redirects": {"delete"},
+		"lockouts":  {"unlock"},
+		"account":   {"totp", "verify", "cancel"},
+	}
+)
+
+func mutating(r *http.Request) bool {
+	for _, a := range mutations[r.FormValue("tab")] {
+		if r.FormValue(a) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfToken returns the token of the current session
+// basic auth users have no session, their token is derived from the user name
+func (s *sessionStore) csrfToken(r *http.Request, user string) string {
+	if ss, ok := s.get(r); ok {
+		return ss.csrf
+	}
+	s.Lock()
+	defer s.Unlock()
+	t, err := s.sign("csrf:" + user)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+func checkCsrf(r *http.Request, token string) error {
+	if r.Method != http.MethodPost {
+		return errPost
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.PostFormValue(csrfField)), []byte(token)) != 1 {
+		return errCsrf
+	}
+	return nil
+}
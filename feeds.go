@@ -0,0 +1,319 @@
+// feeds are generated from the post index, only published posts are included
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	feedUrlRe    = regexp.MustCompile(`(?i)(\s(?:href|src)\s*=\s*")([^"]*)"`)
+	feedSrcsetRe = regexp.MustCompile(`(?i)(\ssrcset\s*=\s*")([^"]*)"`)
+)
+
+type feedItem struct {
+	meta postMetadata
+	link string
+	html string
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DcNs    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Generator     string    `xml:"generator"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Creator     string  `xml:"dc:creator"`
+	Description string  `xml:"description"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Base      string      `xml:"xml:base,attr"`
+	Title     string      `xml:"title"`
+	Subtitle  string      `xml:"subtitle"`
+	Id        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Generator string      `xml:"generator"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	Id        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            string           `json:"id"`
+	Url           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHtml   string           `json:"content_html"`
+	Summary       string           `json:"summary,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type sitemapUrlSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+type sitemapUrl struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func baseUrl(r *http.Request) string {
+	if *siteUrl != "" {
+		return strings.TrimSuffix(*siteUrl, "/")
+	}
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// feedHtml makes root relative links and images absolute, rss and json feeds have no base url
+// html comments are dropped, they carry post metadata
+func feedHtml(h, base string) string {
+	abs := func(u string) string {
+		if strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") {
+			return base + u
+		}
+		return u
+	}
+	h = htmlCommentRe.ReplaceAllString(h, "")
+	h = feedUrlRe.ReplaceAllStringFunc(h, func(a string) string {
+		m := feedUrlRe.FindStringSubmatch(a)
+		return m[1] + abs(m[2]) + `"`
+	})
+	return feedSrcsetRe.ReplaceAllStringFunc(h, func(a string) string {
+		m := feedSrcsetRe.FindStringSubmatch(a)
+		set := strings.Split(m[2], ",")
+		for i, c := range set {
+			set[i] = abs(strings.TrimSpace(c))
+		}
+		return m[1] + strings.Join(set, ", ") + `"`
+	})
+}
+
+// feedPosts returns up to feedLen latest published posts rendered to html
+func feedPosts(base string) []feedItem {
+	idx.RLock()
+	seq := idx.pubSorted
+	idx.RUnlock()
+	items := []feedItem{}
+	for _, s := range seq {
+		if len(items) >= *feedLen {
+			break
+		}
+		idx.RLock()
+		m := idx.metaData[s]
+		idx.RUnlock()
+		if !m.visible() {
+			continue
+		}
+		postMd, err := readPost(s)
+		if err != nil {
+			log.Printf("feed: unable to read post %q: %v", s, err)
+			continue
+		}
+		link := base + "/" + m.url
+		if !*feedFull {
+			ix := bytes.Index(postMd, moreTag)
+			if ix != -1 {
+				postMd = postMd[:ix]
+				postMd = append(postMd, []byte("<BR>[Continue Reading...]("+link+")")...)
+			}
+		}
+		items = append(items, feedItem{
+			meta: m,
+			link: link,
+			html: feedHtml(renderMd(postMd, link, "By "+m.author), base),
+		})
+	}
+	return items
+}
+
+func handleRss(w http.ResponseWriter, r *http.Request) {
+	base := baseUrl(r)
+	rss := rssFeed{
+		Version: "2.0",
+		DcNs:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         *siteName,
+			Link:          base + "/",
+			Description:   *subTitle,
+			Generator:     "BloKi",
+			LastBuildDate: time.Now().Format(time.RFC1123Z),
+		},
+	}
+	for _, i := range feedPosts(base) {
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       i.meta.title,
+			Link:        i.link,
+			Guid:        rssGuid{IsPermaLink: true, Value: i.link},
+			PubDate:     i.meta.published.Format(time.RFC1123Z),
+			Creator:     i.meta.author,
+			Description: i.html,
+		})
+	}
+	writeXml(w, "application/rss+xml", rss)
+}
+
+func handleAtom(w http.ResponseWriter, r *http.Request) {
+	base := baseUrl(r)
+	atom := atomFeed{
+		Base:      base + "/",
+		Title:     *siteName,
+		Subtitle:  *subTitle,
+		Id:        base + "/",
+		Generator: "BloKi",
+		Links: []atomLink{
+			{Href: base + "/atom.xml", Rel: "self", Type: "application/atom+xml"},
+			{Href: base + "/", Rel: "alternate", Type: "text/html"},
+		},
+	}
+	upd := time.Time{}
+	for _, i := range feedPosts(base) {
+		if i.meta.modified.After(upd) {
+			upd = i.meta.modified
+		}
+		atom.Entries = append(atom.Entries, atomEntry{
+			Title:     i.meta.title,
+			Id:        i.link,
+			Link:      atomLink{Href: i.link, Rel: "alternate", Type: "text/html"},
+			Published: i.meta.published.Format(time.RFC3339),
+			Updated:   i.meta.modified.Format(time.RFC3339),
+			Author:    atomAuthor{Name: i.meta.author},
+			Content:   atomContent{Type: "html", Value: i.html},
+		})
+	}
+	if upd.IsZero() {
+		upd = time.Now()
+	}
+	atom.Updated = upd.Format(time.RFC3339)
+	writeXml(w, "application/atom+xml", atom)
+}
+
+func handleJsonFeed(w http.ResponseWriter, r *http.Request) {
+	base := baseUrl(r)
+	jf := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       *siteName,
+		HomePageUrl: base + "/",
+		FeedUrl:     base + "/feed.json",
+		Description: *subTitle,
+		Items:       []jsonFeedItem{},
+	}
+	for _, i := range feedPosts(base) {
+		jf.Items = append(jf.Items, jsonFeedItem{
+			Id:            i.link,
+			Url:           i.link,
+			Title:         i.meta.title,
+			ContentHtml:   i.html,
+			Summary:       i.meta.summary,
+			DatePublished: i.meta.published.Format(time.RFC3339),
+			DateModified:  i.meta.modified.Format(time.RFC3339),
+			Authors:       []jsonFeedAuthor{{Name: i.meta.author}},
+			Tags:          i.meta.tags,
+		})
+	}
+	j, err := json.MarshalIndent(jf, "", "  ")
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	w.Write(j)
+}
+
+func handleSitemap(w http.ResponseWriter, r *http.Request) {
+	base := baseUrl(r)
+	sm := sitemapUrlSet{Urls: []sitemapUrl{{Loc: base + "/"}}}
+	idx.RLock()
+	for _, s := range idx.pubSorted {
+		m := idx.metaData[s]
+		if !m.visible() {
+			continue
+		}
+		sm.Urls = append(sm.Urls, sitemapUrl{Loc: base + "/" + m.url, LastMod: m.modified.Format(time.RFC3339)})
+	}
+	idx.RUnlock()
+	writeXml(w, "application/xml", sm)
+}
+
+func writeXml(w http.ResponseWriter, contentType string, v any) {
+	x, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(x)
+}
@@ -0,0 +1,127 @@
+// front matter is a leading yaml (---) or toml (+++) metadata block
+// as used by hugo and jekyll, it's an alternative to the html comment metadata
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var fmDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	timeFormat,
+	"2006-01-02",
+}
+
+type frontMatter struct {
+	title   string
+	author  string
+	date    time.Time
+	tags    []string
+	summary string
+	slug    string
+	draft   bool
+}
+
+// splitFrontMatter returns the front matter block delimiter, the block and the remaining markdown
+func splitFrontMatter(md []byte) (string, []byte, []byte) {
+	md = bytes.TrimPrefix(md, []byte("\xef\xbb\xbf"))
+	for _, d := range []string{"---", "+++"} {
+		if !bytes.HasPrefix(md, []byte(d+"\n")) && !bytes.HasPrefix(md, []byte(d+"\r\n")) {
+			continue
+		}
+		rest := md[bytes.IndexByte(md, '\n')+1:]
+		for o := 0; o < len(rest); {
+			e := bytes.IndexByte(rest[o:], '\n')
+			if e == -1 {
+				e = len(rest) - o
+			}
+			if strings.TrimRight(string(rest[o:o+e]), "\r") == d {
+				return d, rest[:o], rest[min(o+e+1, len(rest)):]
+			}
+			o += e + 1
+		}
+	}
+	return "", nil, md
+}
+
+// stripFrontMatter removes front matter so it's not rendered as markdown
+func stripFrontMatter(md []byte) []byte {
+	_, _, body := splitFrontMatter(md)
+	return body
+}
+
+func parseFrontMatter(md []byte) (frontMatter, bool, error) {
+	fm := frontMatter{}
+	d, block, _ := splitFrontMatter(md)
+	raw := map[string]any{}
+	switch d {
+	case "---":
+		err := yaml.Unmarshal(block, &raw)
+		if err != nil {
+			return fm, false, fmt.Errorf("yaml front matter: %v", err)
+		}
+	case "+++":
+		err := toml.Unmarshal(block, &raw)
+		if err != nil {
+			return fm, false, fmt.Errorf("toml front matter: %v", err)
+		}
+	default:
+		return fm, false, nil
+	}
+	for k, v := range raw {
+		switch strings.ToLower(k) {
+		case "title":
+			fm.title = fmt.Sprint(v)
+		case "author":
+			fm.author = fmt.Sprint(v)
+		case "date":
+			fm.date = fmDate(v)
+		case "tags", "categories":
+			fm.tags = append(fm.tags, fmTags(v)...)
+		case "summary", "description":
+			fm.summary = fmt.Sprint(v)
+		case "slug":
+			fm.slug = fmt.Sprint(v)
+		case "draft":
+			fm.draft, _ = v.(bool)
+		}
+	}
+	return fm, true, nil
+}
+
+func fmDate(v any) time.Time {
+	switch d := v.(type) {
+	case time.Time:
+		return d
+	case string:
+		for _, f := range fmDateFormats {
+			t, err := time.ParseInLocation(f, d, time.Local)
+			if err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func fmTags(v any) []string {
+	switch t := v.(type) {
+	case string:
+		return parseTags(t)
+	case []any:
+		tags := []string{}
+		for _, i := range t {
+			tags = append(tags, parseTags(fmt.Sprint(i))...)
+		}
+		return tags
+	}
+	return nil
+}
@@ -4,14 +4,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 func gitInit() error {
@@ -27,6 +32,11 @@ func gitInit() error {
 }
 
 func gitAdd(file, user string) error {
+	return gitCommit(file, user, "User "+user+" modified "+file)
+}
+
+// gitCommit adds the file and commits it with the given message
+func gitCommit(file, user, msg string) error {
 	if !*useGit {
 		return nil
 	}
@@ -42,7 +52,7 @@ func gitAdd(file, user string) error {
 	if err != nil {
 		return fmt.Errorf("unable to add git file %v: %v", file, err)
 	}
-	hash, err := wt.Commit("User "+user+" modified "+file, &git.CommitOptions{
+	hash, err := wt.Commit(msg, &git.CommitOptions{
 		Author: &object.Signature{
 			Name: user,
 			When: time.Now(),
@@ -84,7 +94,11 @@ func gitDelete(file, user string) error {
 	return nil
 }
 
+// gitMove refuses to replace an existing file, os.Rename would silently overwrite it
 func gitMove(old, new, user string) error {
+	if _, err := os.Lstat(path.Join(*rootDir, new)); err == nil {
+		return fmt.Errorf("%v already exists", new)
+	}
 	if !*useGit {
 		log.Printf("User %v renamed %v to %v", user, old, new)
 		return os.Rename(path.Join(*rootDir, old), path.Join(*rootDir, new))
@@ -115,6 +129,7 @@ func gitMove(old, new, user string) error {
 }
 
 type commitList struct {
+	hash    string
 	author  string
 	time    time.Time
 	message string
@@ -138,7 +153,35 @@ func gitList() ([]commitList, error) {
 	}
 	cl := []commitList{}
 	err = iter.ForEach(func(c *object.Commit) error {
-		cl = append(cl, commitList{author: c.Author.String(), time: c.Committer.When, message: c.Message})
+		cl = append(cl, commitList{hash: c.Hash.String(), author: c.Author.String(), time: c.Committer.When, message: c.Message})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to iterate through commit log: %v", err)
+	}
+	return cl, nil
+}
+
+// gitLog lists commits which modified the file, newest first
+func gitLog(file string) ([]commitList, error) {
+	if !*useGit {
+		return nil, nil
+	}
+	gr, err := git.PlainOpen(*rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open git repo: %v", err)
+	}
+	ref, err := gr.Head()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get head: %v", err)
+	}
+	iter, err := gr.Log(&git.LogOptions{From: ref.Hash(), FileName: &file})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get commit log of %v: %v", file, err)
+	}
+	cl := []commitList{}
+	err = iter.ForEach(func(c *object.Commit) error {
+		cl = append(cl, commitList{hash: c.Hash.String(), author: c.Author.Name, time: c.Committer.When, message: c.Message})
 		return nil
 	})
 	if err != nil {
@@ -146,3 +189,48 @@ func gitList() ([]commitList, error) {
 	}
 	return cl, nil
 }
+
+// gitShow returns content of the file at the given commit
+func gitShow(file, hash string) ([]byte, error) {
+	if !*useGit {
+		return nil, errors.New("git is disabled")
+	}
+	gr, err := git.PlainOpen(*rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open git repo: %v", err)
+	}
+	c, err := gr.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, fmt.Errorf("unable to find commit %v: %v", hash, err)
+	}
+	f, err := c.File(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find %v in commit %v: %v", file, hash, err)
+	}
+	s, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %v from commit %v: %v", file, hash, err)
+	}
+	return []byte(s), nil
+}
+
+// lineDiff compares two texts line by line
+func lineDiff(a, b string) []diffLine {
+	dl := []diffLine{}
+	for _, d := range diff.Do(a, b) {
+		op := 0
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			op = -1
+		case diffmatchpatch.DiffInsert:
+			op = 1
+		}
+		for _, l := range strings.SplitAfter(d.Text, "\n") {
+			if l == "" {
+				continue
+			}
+			dl = append(dl, diffLine{op: op, text: strings.TrimSuffix(l, "\n")})
+		}
+	}
+	return dl
+}
@@ -0,0 +1,213 @@
+// gopher serves the site over RFC 1436, posts are plain text rendered like text mode pages
+// the root menu lists latest posts, with menus of all posts, media files and a search
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gopherMenu builds a gopher menu, host and port are those clients should connect to
+type gopherMenu struct {
+	buf  strings.Builder
+	host string
+	port string
+}
+
+func (g *gopherMenu) item(typ byte, text, sel string) {
+	fmt.Fprintf(&g.buf, "%c%v\t%v\t%v\t%v\r\n", typ, strings.ReplaceAll(text, "\t", " "), sel, g.host, g.port)
+}
+
+func (g *gopherMenu) info(text string) {
+	for _, ln := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		fmt.Fprintf(&g.buf, "i%v\t\tnull.host\t1\r\n", strings.ReplaceAll(ln, "\t", " "))
+	}
+}
+
+func (g *gopherMenu) posts(seq []string) {
+	idx.RLock()
+	defer idx.RUnlock()
+	for _, s := range seq {
+		m := idx.metaData[s]
+		if !m.visible() {
+			continue
+		}
+		g.item('0', m.published.Format("2006-01-02")+" "+m.title, "/"+m.url)
+	}
+}
+
+// gopherType returns item type of a media file
+func gopherType(file string) byte {
+	t := mime.TypeByExtension(filepath.Ext(file))
+	switch {
+	case t == "image/gif":
+		return 'g'
+	case strings.HasPrefix(t, "image/"):
+		return 'I'
+	case strings.HasPrefix(t, "text/"):
+		return '0'
+	}
+	return '9'
+}
+
+// gopherText terminates a text item, lines starting with a dot are escaped
+func gopherText(text string) string {
+	buf := strings.Builder{}
+	for _, ln := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if strings.HasPrefix(ln, ".") {
+			ln = "." + ln
+		}
+		buf.WriteString(ln + "\r\n")
+	}
+	buf.WriteString(".\r\n")
+	return buf.String()
+}
+
+// gopherUrl returns gopher url of a local link, empty for pages only served over http, eg. tags
+func gopherUrl(hostport, u string) string {
+	u, _, _ = strings.Cut(u, "#")
+	switch {
+	case u == "/":
+		return "gopher://" + hostport + "/1/"
+	case strings.HasPrefix(u, "/media/"):
+		return "gopher://" + hostport + "/" + string(gopherType(u)) + u
+	case strings.HasPrefix(u, "/tag/") || strings.Contains(u, "?"):
+		return ""
+	}
+	return "gopher://" + hostport + "/0" + u
+}
+
+// gopherPost renders a visible post with backlinks and link references
+// local links point to the web site, or to the gopher server if -site_url is not set
+func gopherPost(file string, g *gopherMenu) (string, error) {
+	td := TemplateData{refs: &textRefs{base: strings.TrimSuffix(*siteUrl, "/")}}
+	if *siteUrl == "" {
+		td.refs.gopher = net.JoinHostPort(g.host, g.port)
+	}
+	err := td.renderArticle(file, -1)
+	if err != nil {
+		return "", err
+	}
+	td.Articles += idx.referencedBy(file, td.refs)
+	if len(td.refs.urls) > 0 {
+		td.Articles += "References:\n" + td.refs.list()
+	}
+	return td.Articles, nil
+}
+
+// serveGopher accepts gopher connections, posts and search use the same index as http
+func serveGopher(l net.Listener) {
+	_, port, err := net.SplitHostPort(*gophAddr)
+	if err != nil {
+		log.Fatalf("invalid gopher address %q: %v", *gophAddr, err)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Printf("gopher: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleGopher(c, port)
+	}
+}
+
+func handleGopher(c net.Conn, port string) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	ln, err := bufio.NewReader(io.LimitReader(c, 1024)).ReadString('\n')
+	if err != nil && ln == "" {
+		return
+	}
+	sel, query, _ := strings.Cut(strings.TrimRight(ln, "\r\n"), "\t")
+	log.Printf("gopher from=%q sel=%q query=%q", c.RemoteAddr(), sel, query)
+	g := gopherMenu{host: gopherHost(c), port: port}
+	switch {
+	case sel == "" || sel == "/":
+		g.info(*siteName + "\n" + *subTitle + "\n ")
+		g.item('7', "Search posts", "/search")
+		g.item('1', "All posts", "/posts")
+		g.item('1', "Media files", "/media/")
+		g.info(" \nLatest posts:")
+		idx.RLock()
+		seq := idx.pubSorted
+		idx.RUnlock()
+		if len(seq) > *ltsPosts {
+			seq = seq[:*ltsPosts]
+		}
+		g.posts(seq)
+	case sel == "/posts":
+		g.info("All posts:")
+		g.posts(idx.listing())
+	case sel == "/search":
+		res := txt.search(query)
+		g.info("Search results for: " + query)
+		if len(res) == 0 {
+			g.info("No posts matched the search criteria.")
+		}
+		g.posts(res)
+	case sel == "/media/":
+		d, err := os.ReadDir(filepath.Join(*rootDir, *mediaDir))
+		if err != nil {
+			log.Printf("gopher: unable to list media: %v", err)
+		}
+		g.info("Media files:")
+		for _, f := range d {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			g.item(gopherType(f.Name()), f.Name(), "/media/"+f.Name())
+		}
+	case strings.HasPrefix(sel, "/media/"):
+		file := path.Base(sel)
+		if strings.HasPrefix(file, ".") {
+			io.WriteString(c, "3Access to "+sel+" is forbidden.\t\tnull.host\t1\r\n.\r\n")
+			return
+		}
+		f, err := os.Open(filepath.Join(*rootDir, *mediaDir, file))
+		if err != nil {
+			io.WriteString(c, "3The file "+sel+" was not found.\t\tnull.host\t1\r\n.\r\n")
+			return
+		}
+		defer f.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Minute))
+		io.Copy(c, f)
+		return
+	default:
+		// selectors are post urls, which are query escaped
+		p, err := url.QueryUnescape(strings.TrimPrefix(sel, "/"))
+		if err == nil {
+			p, err = gopherPost(idx.file(p), &g)
+		}
+		if err != nil {
+			io.WriteString(c, "3The post "+sel+" was not found.\t\tnull.host\t1\r\n.\r\n")
+			return
+		}
+		io.WriteString(c, gopherText(p))
+		return
+	}
+	g.buf.WriteString(".\r\n")
+	io.WriteString(c, g.buf.String())
+}
+
+// gopherHost returns host name for menus, from -site_url or the address the client connected to
+func gopherHost(c net.Conn) string {
+	if u, err := url.Parse(*siteUrl); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	h, _, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		return "localhost"
+	}
+	return h
+}
@@ -0,0 +1,184 @@
+// history shows git revisions of a single post, compares them and restores old versions
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path"
+	"strings"
+)
+
+// lines of unchanged context shown around changes in a diff
+const diffContext = 3
+
+type diffLine struct {
+	op   int // -1 removed, 0 unchanged, 1 added
+	text string
+}
+
+func shortHash(h string) string {
+	if len(h) > 7 {
+		return h[:7]
+	}
+	return h
+}
+
+func (p post) history(file, msg string) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." {
+		return p.list("")
+	}
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	cl, err := gitLog(path.Join(*postsDir, file))
+	if err != nil {
+		return "", err
+	}
+	if msg != "" {
+		msg = msg + "<P>\n"
+	}
+	buf := strings.Builder{}
+	buf.WriteString(`<H1>History - ` + html.EscapeString(file) + `</H1>
+	` + msg + `
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="posts">
+	<INPUT TYPE="HIDDEN" NAME="filename" VALUE="` + html.EscapeString(file) + `">
+	<INPUT TYPE="SUBMIT" NAME="diff" VALUE="Compare">
+	<INPUT TYPE="SUBMIT" NAME="revision" VALUE="View">
+	<INPUT TYPE="SUBMIT" NAME="restore" VALUE="Restore this version" ONCLICK="this.value=confirm('Are you sure you want to restore this version?');">
+	<INPUT TYPE="SUBMIT" NAME="cancel" VALUE="Back">
+	<P>
+	Compare shows changes from Old to New revision, View and Restore use the New revision.
+	<P>
+	<TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="10" CELLSPACING="0" BORDER="0">
+	<TR ALIGN="LEFT"><TH>Old</TH><TH>New</TH><TH>Commit</TH><TH>Author</TH><TH>Date</TH><TH>Message</TH></TR>
+	`)
+	for i, c := range cl {
+		chk := map[bool]string{true: " CHECKED", false: ""}
+		buf.WriteString("<TR BGCOLOR=\"" + bgf[i%2 == 0] + "\">" +
+			"<TD><INPUT TYPE=\"radio\" NAME=\"from\" VALUE=\"" + c.hash + "\"" + chk[i == 1] + "></TD>" +
+			"<TD><INPUT TYPE=\"radio\" NAME=\"to\" VALUE=\"" + c.hash + "\"" + chk[i == 0] + "></TD>" +
+			"<TD><TT>" + shortHash(c.hash) + "</TT></TD>" +
+			"<TD>" + html.EscapeString(c.author) + "</TD>" +
+			"<TD>" + c.time.Format(timeFormat) + "</TD>" +
+			"<TD>" + html.EscapeString(c.message) + "</TD></TR>\n")
+	}
+	if len(cl) == 0 {
+		buf.WriteString("<TR><TD COLSPAN=\"6\">No revisions found.</TD></TR>\n")
+	}
+	buf.WriteString("</TABLE>\n")
+	return buf.String(), nil
+}
+
+// revHeader renders title and navigation of the revision and diff views
+func (p post) revHeader(title, file, to string) string {
+	return `<H1>` + title + `</H1>
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="posts">
+	<INPUT TYPE="HIDDEN" NAME="filename" VALUE="` + html.EscapeString(file) + `">
+	<INPUT TYPE="HIDDEN" NAME="to" VALUE="` + html.EscapeString(to) + `">
+	<INPUT TYPE="SUBMIT" NAME="history" VALUE="Back to History">
+	<INPUT TYPE="SUBMIT" NAME="restore" VALUE="Restore ` + shortHash(html.EscapeString(to)) + `" ONCLICK="this.value=confirm('Are you sure you want to restore this version?');">
+	<P>
+	`
+}
+
+func (p post) revision(file, rev string) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." || rev == "" {
+		return p.history(file, "")
+	}
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	data, err := gitShow(path.Join(*postsDir, file), rev)
+	if err != nil {
+		return "", err
+	}
+	return p.revHeader(html.EscapeString(file)+" @ "+shortHash(html.EscapeString(rev)), file, rev) +
+		"<TABLE WIDTH=\"100%\" BGCOLOR=\"#FFFFFF\" CELLPADDING=\"10\" CELLSPACING=\"0\" BORDER=\"0\"><TR><TD><PRE>" +
+		html.EscapeString(string(data)) + "</PRE></TD></TR></TABLE>\n", nil
+}
+
+func (p post) diff(file, from, to string) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." || from == "" || to == "" {
+		return p.history(file, "Select Old and New revision to compare.")
+	}
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	a, err := gitShow(path.Join(*postsDir, file), from)
+	if err != nil {
+		return "", err
+	}
+	b, err := gitShow(path.Join(*postsDir, file), to)
+	if err != nil {
+		return "", err
+	}
+	buf := strings.Builder{}
+	buf.WriteString(p.revHeader(html.EscapeString(file)+" "+shortHash(html.EscapeString(from))+" &rarr; "+shortHash(html.EscapeString(to)), file, to))
+	buf.WriteString("<TABLE WIDTH=\"100%\" BGCOLOR=\"#FFFFFF\" CELLPADDING=\"10\" CELLSPACING=\"0\" BORDER=\"0\"><TR><TD><PRE>")
+	buf.WriteString(renderDiff(lineDiff(string(a), string(b))))
+	buf.WriteString("</PRE></TD></TR></TABLE>\n")
+	return buf.String(), nil
+}
+
+// renderDiff formats a unified diff, unchanged lines far from any change are skipped
+func renderDiff(dl []diffLine) string {
+	near := make([]bool, len(dl))
+	for i, l := range dl {
+		if l.op == 0 {
+			continue
+		}
+		for j := i - diffContext; j <= i+diffContext; j++ {
+			if j >= 0 && j < len(dl) {
+				near[j] = true
+			}
+		}
+	}
+	buf := strings.Builder{}
+	skip := false
+	for i, l := range dl {
+		switch {
+		case l.op == -1:
+			buf.WriteString("<FONT COLOR=\"#C00000\">-" + html.EscapeString(l.text) + "</FONT>\n")
+		case l.op == 1:
+			buf.WriteString("<FONT COLOR=\"#008000\">+" + html.EscapeString(l.text) + "</FONT>\n")
+		case near[i]:
+			buf.WriteString(" " + html.EscapeString(l.text) + "\n")
+		case !skip:
+			buf.WriteString("<FONT COLOR=\"#808080\">...</FONT>\n")
+		}
+		skip = l.op == 0 && !near[i]
+	}
+	if buf.Len() == 0 {
+		return "No differences."
+	}
+	return buf.String()
+}
+
+// restore saves an old revision of the post as a new commit
+func (p post) restore(file, rev string) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." || rev == "" {
+		return p.history(file, "")
+	}
+	data, err := gitShow(path.Join(*postsDir, file), rev)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("refusing to restore empty revision of " + file)
+	}
+	_, err = p.save(file, "", string(data))
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Restored (%v) post %q to revision %v", p.user, file, rev)
+	return p.history(file, fmt.Sprintf("Restored %v to revision %v.", html.EscapeString(file), shortHash(html.EscapeString(rev))))
+}
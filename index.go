@@ -19,16 +19,22 @@ import (
 
 var (
 	timeFormat  = "2006-01-02 15:04"
-	publishedRe = regexp.MustCompile(`<!--.*published="(.+)".*-->`)
+	publishedRe = regexp.MustCompile(`<!--(?:.*\s)?published="([^"]+)".*-->`)
 	authorRe    = regexp.MustCompile(`<!--.*author="(.+)".*-->`)
+	tagsRe      = regexp.MustCompile(`<!--.*tags="(.+)".*-->`)
 	titleRe     = regexp.MustCompile(`(?m)^#\s+(.+)`)
 )
 
 type postIndex struct {
-	pubSorted   []string
+	pubSorted   []string // newest first, for feeds, sitemap and latest posts
+	titleSorted []string // wiki mode page listing
 	metaData    map[string]postMetadata
+	titles      map[string][]string // lower case title to files, several posts may share a title
+	backLinks   map[string][]string
 	pageLast    int
 	latestPosts string
+	tagCloud    string
+	nextPub     time.Time
 
 	sync.RWMutex
 }
@@ -39,12 +45,16 @@ type postMetadata struct {
 	modified  time.Time
 	title     string
 	url       string
+	tags      []string
+	summary   string
+	links     []string
 }
 
 func (idx *postIndex) rescan() {
 	start := time.Now()
 	idx.Lock()
 	idx.metaData = make(map[string]postMetadata)
+	idx.titles = make(map[string][]string)
 	idx.Unlock()
 	d, err := os.ReadDir(path.Join(*rootDir, *postsDir))
 	if err != nil {
@@ -63,24 +73,130 @@ func (idx *postIndex) sequence() {
 	seq := []string{}
 	idx.Lock()
 	defer idx.Unlock()
-	for n := range idx.metaData {
+	idx.nextPub = time.Time{}
+	for n, m := range idx.metaData {
+		if m.scheduled() && (idx.nextPub.IsZero() || m.published.Before(idx.nextPub)) {
+			idx.nextPub = m.published
+		}
+		if !m.visible() {
+			continue
+		}
 		seq = append(seq, n)
 	}
 	sort.Slice(seq, func(i, j int) bool {
 		return idx.metaData[seq[j]].published.Before(idx.metaData[seq[i]].published)
 	})
 	idx.pubSorted = seq
+	idx.titleSorted = nil
+	if *wikiMode {
+		idx.titleSorted = append([]string{}, seq...)
+		sort.SliceStable(idx.titleSorted, func(i, j int) bool {
+			return strings.ToLower(idx.metaData[idx.titleSorted[i]].title) < strings.ToLower(idx.metaData[idx.titleSorted[j]].title)
+		})
+	}
+	idx.linkBack()
 	idx.pageLast = int(math.Ceil(float64(len(seq))/float64(*artPerPg)) - 1)
 	idx.latestPosts = ""
 	for i, s := range seq {
 		if i >= *ltsPosts {
 			break
 		}
-		if idx.metaData[s].published.IsZero() {
+		if !idx.metaData[s].visible() {
 			continue
 		}
 		idx.latestPosts += fmt.Sprintf("&raquo; <a href=\"/%v\">%v</a><br>\n", url.QueryEscape(idx.metaData[s].url), html.EscapeString(idx.metaData[s].title))
 	}
+	tc := map[string]int{}
+	for _, s := range seq {
+		if !idx.metaData[s].visible() {
+			continue
+		}
+		for _, t := range idx.metaData[s].tags {
+			tc[t]++
+		}
+	}
+	tags := []string{}
+	max := 0
+	for t, c := range tc {
+		tags = append(tags, t)
+		if c > max {
+			max = c
+		}
+	}
+	sort.Strings(tags)
+	idx.tagCloud = ""
+	for _, t := range tags {
+		idx.tagCloud += fmt.Sprintf("<font size=\"%v\"><a href=\"%v\">%v</a></font>\n", 2+(3*tc[t])/max, tagUrl(t), html.EscapeString(t))
+	}
+}
+
+// schedule re-sequences the index when a scheduled post becomes due
+func (idx *postIndex) schedule() {
+	for range time.Tick(time.Minute) {
+		idx.RLock()
+		next := idx.nextPub
+		idx.RUnlock()
+		if next.IsZero() || next.After(time.Now()) {
+			continue
+		}
+		log.Printf("idx: scheduled post due at %v, resequencing", next.Format(timeFormat))
+		idx.sequence()
+	}
+}
+
+// visible posts are published and the publish date has passed
+func (m postMetadata) visible() bool {
+	return !m.published.IsZero() && !m.published.After(time.Now())
+}
+
+func (m postMetadata) scheduled() bool {
+	return m.published.After(time.Now())
+}
+
+// listing returns visible posts in the order of the home page, by title in wiki mode
+func (idx *postIndex) listing() []string {
+	idx.RLock()
+	defer idx.RUnlock()
+	if *wikiMode {
+		return idx.titleSorted
+	}
+	return idx.pubSorted
+}
+
+// tagged returns published posts carrying the tag, newest first
+func (idx *postIndex) tagged(tag string) []string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	idx.RLock()
+	defer idx.RUnlock()
+	seq := []string{}
+	for _, s := range idx.pubSorted {
+		if !idx.metaData[s].visible() {
+			continue
+		}
+		for _, t := range idx.metaData[s].tags {
+			if t == tag {
+				seq = append(seq, s)
+				break
+			}
+		}
+	}
+	return seq
+}
+
+func parseTags(s string) []string {
+	tags := []string{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+func tagUrl(tag string) string {
+	return "/tag/" + url.PathEscape(tag)
 }
 
 func (idx *postIndex) addOnly(name string) bool {
@@ -101,6 +217,19 @@ func (idx *postIndex) addOnly(name string) bool {
 		log.Printf("error reading %v: %v", name, err)
 		return false
 	}
+	md := postMeta(name, a)
+	md.modified = fi.ModTime()
+	idx.Lock()
+	defer idx.Unlock()
+	idx.untitle(name)
+	idx.metaData[name] = md
+	idx.titles[strings.ToLower(md.title)] = append(idx.titles[strings.ToLower(md.title)], name)
+	log.Printf("idx: added %q (%v)", name, idx.metaData[name].title)
+	return true
+}
+
+// postMeta parses post metadata from html comments or front matter
+func postMeta(name string, a []byte) postMetadata {
 	author := authorRe.FindSubmatch(a)
 	if len(author) < 2 {
 		author = [][]byte{[]byte(""), []byte("unknown")}
@@ -109,26 +238,88 @@ func (idx *postIndex) addOnly(name string) bool {
 	if len(m) < 1 {
 		m = [][]byte{[]byte(""), []byte("")}
 	}
-	title := titleRe.FindSubmatch(a)
+	title := titleRe.FindSubmatch(stripFrontMatter(a))
 	if len(title) < 2 {
 		title = [][]byte{[]byte(""), []byte(strings.TrimSuffix(name, ".md"))}
 	}
-	t, err := time.Parse(timeFormat, string(m[1]))
+	tags := tagsRe.FindSubmatch(a)
+	if len(tags) < 2 {
+		tags = [][]byte{[]byte(""), []byte("")}
+	}
+	t, err := time.ParseInLocation(timeFormat, string(m[1]), time.Local)
 	if err != nil {
 		t = time.Time{}
 	}
-	idx.Lock()
-	defer idx.Unlock()
-	// TODO: add title from regexp
-	idx.metaData[name] = postMetadata{
-		modified:  fi.ModTime(),
+	md := postMetadata{
 		published: t,
 		author:    string(author[1]),
 		title:     strings.TrimSuffix(string(title[1]), "\r"),
 		url:       url.QueryEscape(strings.TrimSuffix(name, ".md")),
+		tags:      parseTags(string(tags[1])),
+		links:     linkTargets(stripFrontMatter(a)),
 	}
-	log.Printf("idx: added %q (%v)", name, idx.metaData[name].title)
-	return true
+	fm, ok, err := parseFrontMatter(a)
+	if err != nil {
+		log.Printf("idx: %v: %v", name, err)
+	}
+	if ok {
+		md.applyFrontMatter(fm)
+	}
+	return md
+}
+
+func (m *postMetadata) applyFrontMatter(fm frontMatter) {
+	if fm.title != "" {
+		m.title = fm.title
+	}
+	if fm.author != "" {
+		m.author = fm.author
+	}
+	if !fm.date.IsZero() {
+		m.published = fm.date
+	}
+	if fm.draft {
+		m.published = time.Time{}
+	}
+	if len(fm.tags) > 0 {
+		m.tags = fm.tags
+	}
+	if fm.slug != "" {
+		m.url = url.QueryEscape(fm.slug)
+	}
+	m.summary = fm.summary
+}
+
+// file finds post file name by its url, which can differ from the file name if slug is set
+func (idx *postIndex) file(name string) string {
+	idx.RLock()
+	defer idx.RUnlock()
+	if _, ok := idx.metaData[name+".md"]; ok {
+		return name + ".md"
+	}
+	for f, m := range idx.metaData {
+		if m.url == url.QueryEscape(name) {
+			return f
+		}
+	}
+	return name + ".md"
+}
+
+func (idx *postIndex) exists(name string) bool {
+	idx.RLock()
+	defer idx.RUnlock()
+	_, ok := idx.metaData[name]
+	return ok
+}
+
+// url returns post url, or one derived from the file name if the post is not indexed
+func (idx *postIndex) url(name string) string {
+	idx.RLock()
+	defer idx.RUnlock()
+	if m, ok := idx.metaData[name]; ok {
+		return m.url
+	}
+	return url.QueryEscape(strings.TrimSuffix(name, ".md"))
 }
 
 func (idx *postIndex) add(name string) {
@@ -144,28 +335,82 @@ func (idx *postIndex) update(name string) {
 func (idx *postIndex) rename(old, new string) {
 	idx.Lock()
 	defer idx.Unlock()
-	for n, p := range idx.pubSorted {
-		if p != old {
-			continue
+	for _, seq := range [][]string{idx.pubSorted, idx.titleSorted} {
+		for n, p := range seq {
+			if p == old {
+				seq[n] = new
+			}
 		}
-		idx.pubSorted[n] = new
 	}
-	idx.metaData[new] = idx.metaData[old]
+	m := idx.metaData[old]
+	if m.url == url.QueryEscape(strings.TrimSuffix(old, ".md")) {
+		m.url = url.QueryEscape(strings.TrimSuffix(new, ".md"))
+	}
+	idx.metaData[new] = m
 	delete(idx.metaData, old)
+	for _, fl := range idx.titles {
+		for i, f := range fl {
+			if f == old {
+				fl[i] = new
+			}
+		}
+	}
+	idx.linkBack()
 	log.Printf("idx: rename %q to %q, new index: %+v", old, new, idx.pubSorted)
 }
 
 func (pi *postIndex) delete(name string) {
 	pi.Lock()
 	defer pi.Unlock()
-	seq := []string{}
-	for _, s := range pi.pubSorted {
-		if s == name {
-			continue
+	without := func(seq []string) []string {
+		out := []string{}
+		for _, s := range seq {
+			if s != name {
+				out = append(out, s)
+			}
 		}
-		seq = append(seq, s)
+		return out
 	}
-	pi.pubSorted = seq
+	pi.pubSorted = without(pi.pubSorted)
+	if pi.titleSorted != nil {
+		pi.titleSorted = without(pi.titleSorted)
+	}
+	pi.untitle(name)
 	delete(pi.metaData, name)
+	pi.linkBack()
 	log.Printf("idx: deleted post %v, new index: %+v", name, pi.pubSorted)
 }
+
+// untitle removes the post from the title map, must be called with the index locked
+func (idx *postIndex) untitle(name string) {
+	m, ok := idx.metaData[name]
+	if !ok {
+		return
+	}
+	t := strings.ToLower(m.title)
+	fl := []string{}
+	for _, f := range idx.titles[t] {
+		if f != name {
+			fl = append(fl, f)
+		}
+	}
+	if len(fl) == 0 {
+		delete(idx.titles, t)
+		return
+	}
+	idx.titles[t] = fl
+}
+
+// titled finds a post by title, visible posts are preferred, must be called with the index locked
+func (idx *postIndex) titled(title string) (string, bool) {
+	fl := idx.titles[strings.ToLower(strings.TrimSpace(title))]
+	for _, f := range fl {
+		if idx.metaData[f].visible() {
+			return f, true
+		}
+	}
+	if len(fl) == 0 {
+		return "", false
+	}
+	return fl[0], true
+}
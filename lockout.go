@@ -0,0 +1,258 @@
+// lockout slows down password guessing on the admin login
+// failures are counted per client ip and per username, once over the limit
+// the client is locked out and every further failure doubles the lockout time
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lockIp   = "ip"
+	lockUser = "user"
+
+	// failures kept at most, guesses of random usernames must not grow memory forever
+	maxFailures = 10000
+)
+
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+type loginThrottle struct {
+	fails  map[string]*failures
+	pruned time.Time
+
+	sync.Mutex
+}
+
+type lockouts struct{}
+
+// clientIp returns address of the client, behind a trusted reverse proxy
+// the right most untrusted address from the client ip header is used
+func clientIp(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if *proxyIps == "" || *ipHeader == "" || !trustedProxy(ip) {
+		return ip
+	}
+	hdr := strings.Split(strings.Join(r.Header.Values(*ipHeader), ","), ",")
+	for i := len(hdr) - 1; i >= 0; i-- {
+		h := strings.TrimSpace(hdr[i])
+		if net.ParseIP(h) == nil {
+			break
+		}
+		ip = h
+		if !trustedProxy(h) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(ip string) bool {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return false
+	}
+	for _, p := range strings.Split(*proxyIps, ",") {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			if a.Equal(net.ParseIP(p)) {
+				return true
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err == nil && n.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// locked returns the remaining lockout time for the ip or user, zero if login is allowed
+func (t *loginThrottle) locked(ip, user string) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	var d time.Duration
+	for _, k := range []string{lockIp + " " + ip, lockUser + " " + user} {
+		f, ok := t.fails[k]
+		if !ok {
+			continue
+		}
+		if r := time.Until(f.until); r > d {
+			d = r
+		}
+	}
+	return d
+}
+
+// expired reports whether failures can be forgotten, failures under the limit after -lockout
+// and failures that led to a lockout after -lockout_max, so that repeated lockouts keep doubling
+func (f *failures) expired(now time.Time) bool {
+	if now.Before(f.until) {
+		return false
+	}
+	if f.count < *loginMax {
+		return now.Sub(f.last) > *lockTime
+	}
+	return now.Sub(f.last) > *lockMax
+}
+
+// prune forgets expired failures, at most once per -lockout unless the map is full
+func (t *loginThrottle) prune(now time.Time) {
+	if len(t.fails) < maxFailures && now.Sub(t.pruned) < *lockTime {
+		return
+	}
+	t.pruned = now
+	for k, f := range t.fails {
+		if f.expired(now) {
+			delete(t.fails, k)
+		}
+	}
+}
+
+// fail records a failed login and locks out the ip and user once over the limit
+func (t *loginThrottle) fail(ip, user string) {
+	if *loginMax <= 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.fails == nil {
+		t.fails = make(map[string]*failures)
+	}
+	now := time.Now()
+	t.prune(now)
+	if *fail2ban {
+		log.Printf("fail2ban: authentication failure for %q from %v", user, ip)
+	}
+	for _, k := range []string{lockIp + " " + ip, lockUser + " " + user} {
+		if k == lockUser+" " {
+			continue
+		}
+		f, ok := t.fails[k]
+		if ok && f.expired(now) {
+			*f = failures{}
+		}
+		if !ok {
+			if len(t.fails) >= maxFailures {
+				log.Printf("lockout: too many failed logins tracked, not counting %v", k)
+				continue
+			}
+			f = &failures{}
+			t.fails[k] = f
+		}
+		f.count++
+		f.last = now
+		if f.count < *loginMax {
+			continue
+		}
+		d := time.Duration(float64(*lockTime) * math.Pow(2, float64(f.count-*loginMax)))
+		if d > *lockMax || d <= 0 {
+			d = *lockMax
+		}
+		f.until = now.Add(d)
+		log.Printf("lockout: locked %v for %v after %v failed logins", k, d, f.count)
+		if *fail2ban {
+			log.Printf("fail2ban: lockout of %v from %v", k, ip)
+		}
+	}
+}
+
+// success clears failures of the ip and user after a successful login
+func (t *loginThrottle) success(ip, user string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.fails, lockIp+" "+ip)
+	delete(t.fails, lockUser+" "+user)
+}
+
+func (t *loginThrottle) unlock(key string) error {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.fails[key]; !ok {
+		return errors.New(key + " is not locked")
+	}
+	delete(t.fails, key)
+	log.Printf("lockout: unlocked %v", key)
+	return nil
+}
+
+// lockedOut rejects a login attempt during lockout
+func lockedOut(w http.ResponseWriter, ip, user string) bool {
+	d := logins.locked(ip, user)
+	if d <= 0 {
+		return false
+	}
+	log.Printf("Locked out %q from %q for %v", user, ip, d.Round(time.Second))
+	w.Header().Set("Retry-After", fmt.Sprint(int(d.Seconds())+1))
+	http.Error(w, "Too many failed login attempts, try again in "+d.Round(time.Second).String(), http.StatusTooManyRequests)
+	return true
+}
+
+func (l lockouts) unlock(key string) (string, error) {
+	key = unescapeOrEmpty(key)
+	if key == "" {
+		return l.list("")
+	}
+	err := logins.unlock(key)
+	if err != nil {
+		return "", err
+	}
+	return l.list("Unlocked: " + html.EscapeString(key))
+}
+
+func (l lockouts) list(msg string) (string, error) {
+	if msg != "" {
+		msg = msg + "<P>\n"
+	}
+	buf := strings.Builder{}
+	buf.WriteString(`<H1>Lockouts</H1>
+	` + msg + `
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="lockouts">
+	<INPUT TYPE="SUBMIT" NAME="unlock" VALUE="Unlock">
+	<P>
+	<TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="10" CELLSPACING="0" BORDER="0">
+	<TR ALIGN="LEFT"><TH>&nbsp;&nbsp;Type</TH><TH>Name</TH><TH>Failures</TH><TH>Last Failure</TH><TH>Locked Until</TH></TR>
+	`)
+	logins.Lock()
+	defer logins.Unlock()
+	keys := []string{}
+	for k := range logins.fails {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		f := logins.fails[k]
+		typ, name, _ := strings.Cut(k, " ")
+		until := "-"
+		if time.Now().Before(f.until) {
+			until = f.until.Format(timeFormat)
+		}
+		buf.WriteString("<TR BGCOLOR=\"" + bgf[i%2 == 0] + "\">" +
+			"<TD><INPUT TYPE=\"radio\" NAME=\"filename\" VALUE=\"" + url.QueryEscape(k) + "\">&nbsp;" + typ + "</TD>" +
+			"<TD>" + html.EscapeString(name) + "</TD>" +
+			"<TD>" + fmt.Sprint(f.count) + "</TD>" +
+			"<TD>" + f.last.Format(timeFormat) + "</TD>" +
+			"<TD>" + until + "</TD></TR>\n")
+	}
+	buf.WriteString("</TABLE>\n")
+	return buf.String(), nil
+}
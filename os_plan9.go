@@ -4,6 +4,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"time"
@@ -22,20 +24,27 @@ func (t *textSearch) update(file string)       {}
 func (t *textSearch) search(_ string) []string { return nil }
 func (t *textSearch) rescan()                  {}
 
-func gitInit() error           { return nil }
-func gitCommit(_, _, _ string) {}
-func gitAdd(_, _ string) error { return nil }
+func gitInit() error                 { return nil }
+func gitCommit(_, _, _ string) error { return nil }
+func gitAdd(_, _ string) error       { return nil }
 func gitDelete(file, _ string) error {
 	return os.Remove(path.Join(*rootDir, file))
 }
 func gitMove(old, new, _ string) error {
+	if _, err := os.Stat(path.Join(*rootDir, new)); err == nil {
+		return fmt.Errorf("%v already exists", new)
+	}
 	return os.Rename(path.Join(*rootDir, old), path.Join(*rootDir, new))
 }
 
 type commitList struct {
+	hash    string
 	author  string
 	time    time.Time
 	message string
 }
 
-func gitList() ([]commitList, error) { return nil, nil }
+func gitList() ([]commitList, error)        { return nil, nil }
+func gitLog(_ string) ([]commitList, error) { return nil, nil }
+func gitShow(_, _ string) ([]byte, error)   { return nil, errors.New("git is not supported on plan9") }
+func lineDiff(_, _ string) []diffLine       { return nil }
@@ -0,0 +1,69 @@
+// passwords are hashed with argon2id, legacy single round salted sha256
+// hashes are still accepted and upgraded on the next successful login
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	kdfArgon2id  = "argon2id"
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeyLen  = 32
+
+	// limits of stored parameters, argon2 panics on zero and a tampered secrets file
+	// shouldn't make each login take minutes or gigabytes
+	argonMaxTime   = 16
+	argonMaxMemory = 1024 * 1024
+	argonMaxKeyLen = 64
+)
+
+// hashPassword sets a new salt and argon2id hash, salt is generated if nil
+func (us *userSecret) hashPassword(pass string, salt []byte) error {
+	if salt == nil {
+		salt = make([]byte, 16)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return err
+		}
+	}
+	us.Kdf = kdfArgon2id
+	us.Time = argonTime
+	us.Memory = argonMemory
+	us.Threads = argonThreads
+	us.Salt = base64.StdEncoding.EncodeToString(salt)
+	us.Hash = base64.StdEncoding.EncodeToString(argon2.IDKey([]byte(pass), salt, us.Time, us.Memory, us.Threads, argonKeyLen))
+	return nil
+}
+
+func (us userSecret) checkPassword(pass string) bool {
+	var hash string
+	switch us.Kdf {
+	case "":
+		hash = fmt.Sprintf("%x", sha256.Sum256([]byte(us.Salt+pass)))
+	case kdfArgon2id:
+		salt, err := base64.StdEncoding.DecodeString(us.Salt)
+		if err != nil {
+			return false
+		}
+		want, err := base64.StdEncoding.DecodeString(us.Hash)
+		if err != nil || len(want) == 0 || len(want) > argonMaxKeyLen {
+			return false
+		}
+		if us.Time < 1 || us.Time > argonMaxTime || us.Threads < 1 || us.Memory < 8*uint32(us.Threads) || us.Memory > argonMaxMemory {
+			return false
+		}
+		hash = base64.StdEncoding.EncodeToString(argon2.IDKey([]byte(pass), salt, us.Time, us.Memory, us.Threads, uint32(len(want))))
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(us.Hash)) == 1
+}
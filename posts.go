@@ -2,16 +2,21 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"html"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/ast"
-	"github.com/gomarkdown/markdown/html"
+	mdhtml "github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
 )
 
@@ -21,21 +26,38 @@ type TemplateData struct {
 	SiteName    string
 	SubTitle    string
 	Articles    string
+	Backlinks   string
 	CharSet     string
 	Paginator   string
+	References  string
 	Page        int
 	PgNewer     int
 	PgOlder     int
 	PgOldest    int
+	PgUrl       string
+	Status      int
+	StatusText  string
+	Error       string
 	LatestPosts string
+	TagCloud    string
 	AdminUrl    string
+	refs        *textRefs
 }
 
 func renderMd(md []byte, name, published string) string {
 	p := parser.NewWithExtensions(parser.CommonExtensions | parser.Autolink)
+	if *wikiMode {
+		p.RegisterInline('[', wikiLink(p.RegisterInline('[', nil)))
+	}
 	d := p.Parse(md)
-	r := html.NewRenderer(html.RendererOptions{
-		RenderNodeHook: func() html.RenderNodeFunc {
+	ast.WalkFunc(d, func(n ast.Node, entering bool) ast.WalkStatus {
+		if img, ok := n.(*ast.Image); ok && entering {
+			responsiveImage(img)
+		}
+		return ast.GoToNext
+	})
+	r := mdhtml.NewRenderer(mdhtml.RendererOptions{
+		RenderNodeHook: func() mdhtml.RenderNodeFunc {
 			return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
 				if h, ok := node.(*ast.Heading); !ok || h.Level != 1 {
 					return ast.GoToNext, false
@@ -53,48 +75,123 @@ func renderMd(md []byte, name, published string) string {
 	return string(markdown.Render(d, r))
 }
 
-func renderError(name, errStr string) string {
-	return string("Article " + name + " " + errStr + "<p>\n\n")
+var errNotFound = errors.New("not found")
+
+// readPost reads post markdown without the front matter
+// if the title is only in the front matter, it's added as a heading
+func readPost(file string) ([]byte, error) {
+	md, err := os.ReadFile(path.Join(*rootDir, *postsDir, file))
+	if err != nil {
+		return nil, err
+	}
+	return postBody(md), nil
 }
 
-func (t *TemplateData) renderArticle(file string, maxLen int) {
+func postBody(md []byte) []byte {
+	fm, ok, _ := parseFrontMatter(md)
+	md = stripFrontMatter(md)
+	if ok && fm.title != "" && !startsWithTitle(md) {
+		md = append([]byte("# "+fm.title+"\n\n"), md...)
+	}
+	return md
+}
+
+// startsWithTitle checks if the first line of the body, skipping metadata comments, is a level 1 heading
+// a # line further down may be anything, eg. a shell comment in a code block
+func startsWithTitle(md []byte) bool {
+	for _, ln := range bytes.Split(md, []byte("\n")) {
+		ln = bytes.TrimSpace(ln)
+		if len(ln) == 0 || (bytes.HasPrefix(ln, []byte("<!--")) && bytes.HasSuffix(ln, []byte("-->"))) {
+			continue
+		}
+		return titleRe.Match(ln)
+	}
+	return false
+}
+
+func (t *TemplateData) renderArticle(file string, maxLen int) error {
 	file = path.Base(unescapeOrEmpty(file))
 	idx.RLock()
 	m := idx.metaData[file]
 	idx.RUnlock()
-	if m.published.IsZero() {
-		// TODO: searchPosts() may find unpublished articles, they would display an error
-		// we also don't want to leak data on a random hit, so say nothing
-		//t.Articles = renderError(name, "is not published") // TODO: better error handling
-		return
+	if !m.visible() {
+		// we don't want to leak data about drafts, so they are not found
+		return errNotFound
 	}
-	postMd, err := os.ReadFile(path.Join(*rootDir, *postsDir, file))
+	postMd, err := readPost(file)
 	if err != nil {
 		log.Printf("unable to read post %q: %v", file, err)
-		t.Articles = renderError(file, "not found") // TODO: better error handling
-		return
+		return err
 	}
+	t.renderPost(m, postMd, maxLen)
+	return nil
+}
+
+func (t *TemplateData) renderPost(m postMetadata, postMd []byte, maxLen int) {
 	// TODO: refactor as a custom ast node and render hook instead
 	if maxLen > 0 {
 		postMd = postMd[:maxLen]
-		postMd = append(postMd, []byte("<BR>[Continue Reading...]("+m.url+")")...)
+		postMd = append(postMd, []byte("<BR>[Continue Reading...](/"+m.url+")")...)
 	} else if maxLen != -1 {
 		ix := bytes.Index(postMd, moreTag)
 		if ix != -1 {
 			postMd = postMd[:ix]
-			postMd = append(postMd, []byte("<BR>[Continue Reading...]("+m.url+")")...)
+			postMd = append(postMd, []byte("<BR>[Continue Reading...](/"+m.url+")")...)
 		}
 	}
 	postMd = append(postMd, []byte("\n\n---\n\n")...)
-	p := "By " + m.author + ", First published: " + m.published.Format(timeFormat) + ", Last updated: " + m.modified.Format(timeFormat)
-	t.Articles += renderMd(postMd, strings.TrimSuffix(file, ".md"), p)
+	if t.refs != nil {
+		t.refs.ref("/" + m.url)
+		t.Articles += t.refs.render(postMd, "/"+m.url, byline(m, func(tg string) string { return tg + t.refs.ref(tagUrl(tg)) }))
+		return
+	}
+	t.Articles += renderMd(postMd, "/"+m.url, byline(m, func(tg string) string {
+		return "<a href=\"" + tagUrl(tg) + "\">" + html.EscapeString(tg) + "</a>"
+	}))
 }
 
-func (t *TemplateData) paginatePosts(pg int) {
+// byline returns author, dates and tags of the post, tag renders a link to the tag
+func byline(m postMetadata, tag func(string) string) string {
+	pub := m.published.Format(timeFormat)
+	if m.published.IsZero() {
+		pub = "not yet"
+	}
+	p := "By " + m.author + ", First published: " + pub + ", Last updated: " + m.modified.Format(timeFormat)
+	if len(m.tags) > 0 {
+		tl := []string{}
+		for _, tg := range m.tags {
+			tl = append(tl, tag(tg))
+		}
+		p += ", Tags: " + strings.Join(tl, ", ")
+	}
+	return p
+}
+
+func (t *TemplateData) paginatePosts(pg int) error {
+	seq := idx.listing()
 	idx.RLock()
-	seq := idx.pubSorted
 	pgl := idx.pageLast
 	idx.RUnlock()
+	return t.paginate(seq, pg, pgl)
+}
+
+func (t *TemplateData) tagPosts(tag string, pg int) error {
+	seq := idx.tagged(tag)
+	if strings.TrimSpace(tag) == "" || len(seq) == 0 {
+		return errNotFound
+	}
+	t.PgUrl = tagUrl(tag)
+	t.Articles = "<H2>Posts tagged: " + html.EscapeString(tag) + "</H2>\n"
+	if t.refs != nil {
+		t.Articles = "Posts tagged: " + tag + "\n\n"
+	}
+	return t.paginate(seq, pg, int(math.Ceil(float64(len(seq))/float64(*artPerPg))-1))
+}
+
+func (t *TemplateData) paginate(seq []string, pg, pgl int) error {
+	if pg < 0 || (pg > 0 && pg > pgl) {
+		return errNotFound
+	}
 	t.Page = pg
 	t.PgOlder = pg + 1
 	t.PgNewer = pg - 1
@@ -102,12 +199,16 @@ func (t *TemplateData) paginatePosts(pg int) {
 	for i := t.Page * (*artPerPg); i < (t.Page+1)*(*artPerPg) && i < len(seq); i++ {
 		t.renderArticle(seq[i], 0)
 	}
+	return nil
 }
 
 func (t *TemplateData) searchPosts(query string) {
 	res := txt.search(query)
 	if len(res) == 0 {
 		t.Articles = "<H1>Nothing found</H1>No posts matched the search criteria."
+		if t.refs != nil {
+			t.Articles = "Nothing found\n\nNo posts matched the search criteria.\n\n"
+		}
 		return
 	}
 	for i := range res {
@@ -115,33 +216,77 @@ func (t *TemplateData) searchPosts(query string) {
 	}
 }
 
+func newTemplateData(r *http.Request) TemplateData {
+	var refs *textRefs
+	if pageTemplate(r) == "text" {
+		refs = &textRefs{base: baseUrl(r), format: r.FormValue("format") == "txt"}
+	}
+	return TemplateData{
+		SiteName:    *siteName,
+		SubTitle:    *subTitle,
+		CharSet:     clientCharset(r),
+		PgUrl:       "/",
+		LatestPosts: func() string { idx.RLock(); defer idx.RUnlock(); return idx.latestPosts }(),
+		TagCloud:    func() string { idx.RLock(); defer idx.RUnlock(); return idx.tagCloud }(),
+		AdminUrl:    *adminUri,
+		refs:        refs,
+	}
+}
+
+// renderErrorPage responds with http error code using the error template
+func renderErrorPage(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	td := newTemplateData(r)
+	td.Status = code
+	td.StatusText = http.StatusText(code)
+	td.Error = msg
+	if td.refs != nil {
+		td.Articles = fmt.Sprintf("%v %v\n\n%v\n\n", code, td.StatusText, html.UnescapeString(msg))
+		renderPage(w, r, code, "text", td)
+		return
+	}
+	renderPage(w, r, code, "error", td)
+}
+
 func handlePosts(w http.ResponseWriter, r *http.Request) {
 	log.Printf("view from=%q uri=%q url=%q, ua=%q", r.RemoteAddr, r.RequestURI, r.URL.Path, r.UserAgent())
 	r.ParseForm()
 	post := path.Base(r.URL.Path)
 	query := unescapeOrEmpty(r.FormValue("query"))
 
-	td := TemplateData{
-		SiteName:    *siteName,
-		SubTitle:    *subTitle,
-		CharSet:     charset[strings.HasPrefix(r.UserAgent(), "Mozilla/5")],
-		LatestPosts: func() string { idx.RLock(); defer idx.RUnlock(); return idx.latestPosts }(),
-		AdminUrl:    *adminUri,
-	}
+	td := newTemplateData(r)
 
+	var err error
 	switch {
+	case strings.HasPrefix(r.URL.Path, "/tag/"):
+		// tags may contain an escaped slash, so the escaped path is used instead of path.Base
+		tag, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/tag/"))
+		err = td.tagPosts(tag, atoiOrZero(r.FormValue("pg")))
 	case len(post) > 1:
-		td.renderArticle(post+".md", -1)
+		if n, ok := redirects.target(idx.file(post)); ok && !idx.exists(idx.file(post)) {
+			http.Redirect(w, r, "/"+idx.url(n), http.StatusMovedPermanently)
+			return
+		}
+		if r.FormValue("preview") != "" {
+			previewShared(w, r, idx.file(post))
+			return
+		}
+		err = td.renderArticle(idx.file(post), -1)
+		if err == nil {
+			td.Backlinks = idx.referencedBy(idx.file(post), td.refs)
+		}
 	case query != "":
 		td.searchPosts(query)
 	default:
-		td.paginatePosts(atoiOrZero(r.FormValue("pg")))
+		err = td.paginatePosts(atoiOrZero(r.FormValue("pg")))
 	}
-
-	w.Header().Set("Content-Type", "text/html")
-	err := templates[vintage(r.UserAgent())].Execute(w, td)
-	if err != nil {
-		log.Print(err.Error())
-		io.WriteString(w, err.Error())
+	switch {
+	case err == errNotFound || os.IsNotExist(err):
+		renderErrorPage(w, r, http.StatusNotFound, "The page "+html.EscapeString(r.URL.Path)+" was not found.")
+		return
+	case err != nil:
+		renderErrorPage(w, r, http.StatusInternalServerError, "Unable to render "+html.EscapeString(r.URL.Path)+".")
+		return
 	}
+
+	renderPage(w, r, http.StatusOK, pageTemplate(r), td)
 }
@@ -0,0 +1,120 @@
+// previews render drafts through the site template, for logged in users from the admin
+// and for reviewers without an account with a secret time limited link
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const previewBanner = `<TABLE WIDTH="100%" BGCOLOR="#FFFF80" CELLPADDING="5" CELLSPACING="0" BORDER="0"><TR><TD ALIGN="CENTER">` +
+	`<B>DRAFT</B> - this is a preview, the post may not be published yet</TD></TR></TABLE>` + "\n"
+
+// previewSig signs file name and expiry time of a preview link
+func previewSig(file string, exp int64) (string, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	return sessions.sign(fmt.Sprintf("preview:%v:%v", file, exp))
+}
+
+// previewValid checks the secret token of a preview link
+func previewValid(file, token string) bool {
+	e, sig, ok := strings.Cut(token, "-")
+	if !ok {
+		return false
+	}
+	exp, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	s, err := previewSig(file, exp)
+	return err == nil && subtle.ConstantTimeCompare([]byte(s), []byte(sig)) == 1
+}
+
+// renderPreview renders post markdown with a draft banner regardless of publish date
+func renderPreview(w http.ResponseWriter, r *http.Request, file string, md []byte) {
+	m := postMeta(file, md)
+	m.modified = time.Now()
+	if fi, err := os.Stat(path.Join(*rootDir, *postsDir, file)); err == nil {
+		m.modified = fi.ModTime()
+	}
+	td := newTemplateData(r)
+	td.Articles = previewBanner
+	if td.refs != nil {
+		td.Articles = "DRAFT - this is a preview, the post may not be published yet\n\n"
+	}
+	td.renderPost(m, postBody(md), -1)
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Cache-Control", "private, no-store")
+	renderPage(w, r, http.StatusOK, pageTemplate(r), td)
+}
+
+// previewShared serves a draft to anyone with a valid preview link
+func previewShared(w http.ResponseWriter, r *http.Request, file string) {
+	if !previewValid(file, r.FormValue("preview")) {
+		log.Printf("Invalid preview link for %q from %q", file, r.RemoteAddr)
+		renderErrorPage(w, r, http.StatusForbidden, "This preview link is invalid or has expired.")
+		return
+	}
+	md, err := os.ReadFile(path.Join(*rootDir, *postsDir, file))
+	if err != nil {
+		renderErrorPage(w, r, http.StatusNotFound, "The page "+html.EscapeString(r.URL.Path)+" was not found.")
+		return
+	}
+	renderPreview(w, r, file, md)
+}
+
+// preview renders the text being edited, or the saved post if there is none
+func (p post) preview(w http.ResponseWriter, r *http.Request) {
+	file := path.Base(unescapeOrEmpty(r.FormValue("filename")))
+	err := p.mayEdit(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	md := []byte(r.FormValue("textdata"))
+	if len(md) == 0 {
+		md, err = os.ReadFile(path.Join(*rootDir, *postsDir, file))
+		if err != nil {
+			http.Error(w, "unable to read "+file, http.StatusNotFound)
+			return
+		}
+	}
+	renderPreview(w, r, file, md)
+}
+
+// shareLink creates a secret preview link for reviewers without an account
+func (p post) shareLink(r *http.Request, file string) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." {
+		return p.list("")
+	}
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	if !idx.exists(file) {
+		return "", fmt.Errorf("post %q not found", file)
+	}
+	exp := time.Now().Add(*prevTtl)
+	sig, err := previewSig(file, exp.Unix())
+	if err != nil {
+		return "", err
+	}
+	l := baseUrl(r) + "/" + idx.url(file) + "?preview=" + fmt.Sprint(exp.Unix()) + "-" + sig
+	log.Printf("Preview link for %q created by %v, expires %v", file, p.user, exp.Format(timeFormat))
+	return `<H1>Preview Link - ` + html.EscapeString(file) + `</H1>
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="posts">
+	Anyone with this link can see the post until ` + exp.Format(timeFormat) + `, even if it's not published:<P>
+	<A HREF="` + html.EscapeString(l) + `" TARGET="_blank"><TT>` + html.EscapeString(l) + `</TT></A><P>
+	<INPUT TYPE="SUBMIT" NAME="cancel" VALUE="Back">
+	`, nil
+}
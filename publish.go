@@ -0,0 +1,90 @@
+// publish and unpublish rewrite the publish metadata of a post, the rest of the text stays intact
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	pubCommentRe = regexp.MustCompile(`(<!--(?:[^>]*\s)?)(not-)?published="([^"]*)"`)
+	fmDraftRe    = regexp.MustCompile(`(?m)^(draft\s*[:=]\s*)(true|false)[ \t\r]*$`)
+	fmDateRe     = regexp.MustCompile(`(?m)^(date\s*[:=][ \t]*)(.*?)[ \t\r]*$`)
+)
+
+// setPublished marks the post text published at t, or unpublished if t is zero
+// html comment and front matter metadata are both updated, if neither sets
+// the publish date a published comment is added at the top of the post
+func setPublished(text []byte, t time.Time) []byte {
+	d, block, body := splitFrontMatter(text)
+	if d != "" {
+		block = fmDraftRe.ReplaceAll(block, []byte("${1}"+strconv.FormatBool(t.IsZero())))
+		if !t.IsZero() {
+			block = fmDateRe.ReplaceAll(block, []byte("${1}"+t.Format(time.RFC3339)))
+		}
+	}
+	if t.IsZero() {
+		body = pubCommentRe.ReplaceAll(body, []byte(`${1}not-published="${3}"`))
+	} else {
+		body = pubCommentRe.ReplaceAll(body, []byte(`${1}published="`+t.Format(timeFormat)+`"`))
+	}
+	join := func() []byte {
+		if d == "" {
+			return body
+		}
+		return append([]byte(d+"\n"+string(block)+d+"\n"), body...)
+	}
+	out := join()
+	pub := postMeta("", out).published
+	switch {
+	case t.IsZero() && !pub.IsZero() && d != "":
+		block = append(block, []byte(map[string]string{"---": "draft: true\n", "+++": "draft = true\n"}[d])...)
+	case !t.IsZero() && pub.IsZero():
+		body = append([]byte(`<!--published="`+t.Format(timeFormat)+`"-->`+"\n"), body...)
+	default:
+		return out
+	}
+	return join()
+}
+
+// publish publishes the post now or turns it back into a draft
+func (p post) publish(file string, pub bool) (string, error) {
+	file = path.Base(unescapeOrEmpty(file))
+	if file == "" || file == "." {
+		return p.list("")
+	}
+	err := p.mayEdit(file)
+	if err != nil {
+		return "", err
+	}
+	postMu.Lock()
+	defer postMu.Unlock()
+	text, err := os.ReadFile(path.Join(*rootDir, *postsDir, file))
+	if err != nil {
+		return "", errors.New("unable to read " + file + " : " + err.Error())
+	}
+	t, act := time.Now(), "published"
+	// a post that is already out keeps its date, only drafts and scheduled posts are published now
+	if pd := postMeta(file, text).published; pub && !pd.IsZero() && !pd.After(t) {
+		return p.list("")
+	}
+	if !pub {
+		t, act = time.Time{}, "unpublished"
+	}
+	text = setPublished(text, t)
+	err = p.mayPublish(string(text))
+	if err != nil {
+		return "", err
+	}
+	err = p.write(file, string(text), "User "+p.user+" "+act+" "+path.Join(*postsDir, file))
+	if err != nil {
+		return "", err
+	}
+	log.Printf("User %v %v post %q", p.user, act, file)
+	return p.list("")
+}
@@ -0,0 +1,162 @@
+// redirects are left behind when posts are renamed so that old urls keep working
+// they are stored in the site directory and versioned in git
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redirectsFile = "redirects.json"
+
+type redirectMap struct {
+	old2new map[string]string
+
+	sync.RWMutex
+}
+
+type redirs struct{ user string }
+
+func (rm *redirectMap) load() {
+	rm.Lock()
+	defer rm.Unlock()
+	rm.old2new = make(map[string]string)
+	f, err := os.ReadFile(path.Join(*rootDir, redirectsFile))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("redirects: unable to read %v: %v", redirectsFile, err)
+		return
+	}
+	err = json.Unmarshal(f, &rm.old2new)
+	if err != nil {
+		log.Printf("redirects: unable to parse %v: %v", redirectsFile, err)
+		return
+	}
+	log.Printf("redirects: loaded %v redirects", len(rm.old2new))
+}
+
+// save must be called with the lock held
+func (rm *redirectMap) save(user string) error {
+	j, err := json.MarshalIndent(rm.old2new, "", "  ")
+	if err != nil {
+		return err
+	}
+	fn := path.Join(*rootDir, redirectsFile)
+	err = os.WriteFile(fn+".tmp", j, 0644)
+	if err != nil {
+		return errors.New("unable to write redirects: " + err.Error())
+	}
+	err = os.Rename(fn+".tmp", fn)
+	if err != nil {
+		return errors.New("unable to rename redirects: " + err.Error())
+	}
+	err = gitAdd(redirectsFile, user)
+	if err != nil {
+		log.Printf("Unable git add %v: %v", redirectsFile, err)
+	}
+	return nil
+}
+
+// add records a rename, chains of renames are collapsed to the final name
+func (rm *redirectMap) add(old, new, user string) error {
+	rm.Lock()
+	defer rm.Unlock()
+	for o, n := range rm.old2new {
+		if n == old {
+			rm.old2new[o] = new
+		}
+		if o == new || rm.old2new[o] == o {
+			delete(rm.old2new, o)
+		}
+	}
+	rm.old2new[old] = new
+	log.Printf("redirects: added %q -> %q", old, new)
+	return rm.save(user)
+}
+
+func (rm *redirectMap) delete(old, user string) error {
+	rm.Lock()
+	defer rm.Unlock()
+	if _, ok := rm.old2new[old]; !ok {
+		return errors.New("redirect " + old + " not found")
+	}
+	delete(rm.old2new, old)
+	log.Printf("redirects: deleted %q", old)
+	return rm.save(user)
+}
+
+// dropTarget removes redirects to a deleted post, so old urls are not found instead of redirecting to nothing
+func (rm *redirectMap) dropTarget(new, user string) error {
+	rm.Lock()
+	defer rm.Unlock()
+	n := 0
+	for o, t := range rm.old2new {
+		if t == new {
+			delete(rm.old2new, o)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	log.Printf("redirects: dropped %v redirects to %q", n, new)
+	return rm.save(user)
+}
+
+func (rm *redirectMap) target(old string) (string, bool) {
+	rm.RLock()
+	defer rm.RUnlock()
+	n, ok := rm.old2new[old]
+	return n, ok
+}
+
+func (r redirs) delete(old string) (string, error) {
+	old = path.Base(unescapeOrEmpty(old))
+	if old == "" || old == "." {
+		return r.list("")
+	}
+	err := redirects.delete(old, r.user)
+	if err != nil {
+		return "", err
+	}
+	return r.list("Deleted redirect: " + html.EscapeString(old))
+}
+
+func (r redirs) list(msg string) (string, error) {
+	if msg != "" {
+		msg = msg + "<P>\n"
+	}
+	buf := strings.Builder{}
+	buf.WriteString(`<H1>Redirects</H1>
+	` + msg + `
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="redirects">
+	<INPUT TYPE="SUBMIT" NAME="delete" VALUE="Delete" ONCLICK="this.value=confirm('Are you sure you want to delete this redirect?');">
+	<P>
+	<TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="10" CELLSPACING="0" BORDER="0">
+	<TR ALIGN="LEFT"><TH>&nbsp;&nbsp;Old Name</TH><TH>New Name</TH></TR>
+	`)
+	redirects.RLock()
+	defer redirects.RUnlock()
+	old := []string{}
+	for o := range redirects.old2new {
+		old = append(old, o)
+	}
+	sort.Strings(old)
+	for i, o := range old {
+		buf.WriteString("<TR BGCOLOR=\"" + bgf[i%2 == 0] + "\">" +
+			"<TD><INPUT TYPE=\"radio\" NAME=\"filename\" VALUE=\"" + url.QueryEscape(o) + "\">&nbsp;" + html.EscapeString(o) + "</TD>" +
+			"<TD>" + html.EscapeString(redirects.old2new[o]) + "</TD></TR>\n")
+	}
+	buf.WriteString("</TABLE>\n")
+	return buf.String(), nil
+}
@@ -0,0 +1,309 @@
+// resize generates scaled down variants of media images and caches them on disk
+// variants are requested with ?w=<width> on /media/ urls, the width is rounded up
+// to one of -image_sizes so the cache can't be filled with arbitrary sizes
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomarkdown/markdown/ast"
+	"golang.org/x/image/draw"
+)
+
+// resizing is cpu and memory heavy, only one image is resized at a time
+var resizeMu sync.Mutex
+
+// larger images are served as is, decoding would take 4 bytes per pixel or more
+const maxImagePixels = 50 * 1000 * 1000
+
+// imageWidths returns allowed variant widths, smallest first
+func imageWidths() []int {
+	ws := []int{}
+	for _, s := range strings.Split(*imgSizes, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || w <= 0 {
+			continue
+		}
+		ws = append(ws, w)
+	}
+	sort.Ints(ws)
+	return ws
+}
+
+// variantWidth rounds the requested width up to an allowed one, 0 means the original
+func variantWidth(w int) int {
+	if w <= 0 {
+		return 0
+	}
+	for _, a := range imageWidths() {
+		if a >= w {
+			return a
+		}
+	}
+	return 0
+}
+
+func mediaFile(file string) string {
+	return filepath.Join(*rootDir, *mediaDir, file)
+}
+
+func variantFile(file, variant string) string {
+	return filepath.Join(*rootDir, *cacheDir, variant, file)
+}
+
+// imageConfig returns format and dimensions of a media image without decoding it
+func imageConfig(file string) (image.Config, string, error) {
+	f, err := os.Open(mediaFile(file))
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer f.Close()
+	return image.DecodeConfig(f)
+}
+
+// cachedVariant returns the variant file if it's newer than the original
+func cachedVariant(file, variant string) (string, bool) {
+	o, err := os.Stat(mediaFile(file))
+	if err != nil {
+		return "", false
+	}
+	v, err := os.Stat(variantFile(file, variant))
+	if err != nil || v.ModTime().Before(o.ModTime()) {
+		return "", false
+	}
+	return variantFile(file, variant), true
+}
+
+// imageVariant is a resized and possibly re-encoded version of media images
+type imageVariant struct {
+	name     string            // cache subdirectory
+	width    int               // maximum width, 0 keeps the original width
+	formats  map[string]string // output format for source format, eg. png to gif
+	palette  color.Palette     // gif palette, plan9 palette if nil
+	quality  int               // jpeg quality
+	reencode bool              // encode even if size and format are unchanged, eg. to baseline jpeg
+}
+
+// widthVariant resizes images to one of -image_sizes widths
+func widthVariant(w int) imageVariant {
+	w = variantWidth(w)
+	return imageVariant{name: strconv.Itoa(w), width: w, quality: 85}
+}
+
+// clientVariant returns reduced size and color variant for legacy and vintage browsers
+func clientVariant(class string, w int) imageVariant {
+	w = variantWidth(w)
+	max := map[string]int{"legacy": *lgcWidth, "vintage": *vntWidth}[class]
+	if max <= 0 {
+		return widthVariant(w)
+	}
+	if w == 0 || w > max {
+		w = max
+	}
+	if class == "legacy" {
+		return imageVariant{name: "legacy-" + strconv.Itoa(w), width: w, quality: 75, reencode: true,
+			formats: map[string]string{"png": "gif"}}
+	}
+	return imageVariant{name: "vintage-" + strconv.Itoa(w), width: w, quality: 60, reencode: true,
+		formats: map[string]string{"png": "gif", "jpeg": "gif"}, palette: palette.WebSafe}
+}
+
+// mediaVariant returns path to the image variant, the original is returned if
+// it doesn't need any changes or can't be decoded, eg. animated gifs or svg
+func mediaVariant(file string, v imageVariant) (string, error) {
+	cfg, format, err := imageConfig(file)
+	if err != nil {
+		return mediaFile(file), nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		log.Printf("resize: %q is %vx%v, too large to resize", file, cfg.Width, cfg.Height)
+		return mediaFile(file), nil
+	}
+	width := v.width
+	if width <= 0 || width > cfg.Width {
+		width = cfg.Width
+	}
+	out := format
+	if f, ok := v.formats[format]; ok {
+		out = f
+	}
+	if width == cfg.Width && out == format && !v.reencode {
+		return mediaFile(file), nil
+	}
+	if p, ok := cachedVariant(file, v.name); ok {
+		return p, nil
+	}
+	resizeMu.Lock()
+	defer resizeMu.Unlock()
+	if p, ok := cachedVariant(file, v.name); ok {
+		return p, nil
+	}
+	img, err := decodeStill(file, format, v.reencode)
+	if err != nil || img == nil {
+		return mediaFile(file), err
+	}
+	h := cfg.Height * width / cfg.Width
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, h))
+	if width == cfg.Width {
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	}
+	err = writeVariant(file, v.name, func(f *os.File) error {
+		switch out {
+		case "jpeg":
+			return jpeg.Encode(f, dst, &jpeg.Options{Quality: v.quality})
+		case "gif":
+			pal := v.palette
+			if pal == nil {
+				pal = palette.Plan9
+			}
+			if !dst.Opaque() && len(pal) >= 256 {
+				// make room for the transparent entry
+				pal = pal[:255:255]
+			}
+			pi := image.NewPaletted(dst.Bounds(), pal)
+			draw.FloydSteinberg.Draw(pi, pi.Bounds(), dst, image.Point{})
+			if !dst.Opaque() {
+				gifTransparency(pi, dst)
+			}
+			return gif.Encode(f, pi, nil)
+		default:
+			return png.Encode(f, dst)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("resize: created %v variant of %q", v.name, file)
+	return variantFile(file, v.name), nil
+}
+
+// gifTransparency adds a transparent palette entry, gif has no alpha channel
+// so pixels of the source that are less than half opaque become transparent
+func gifTransparency(pi *image.Paletted, src *image.RGBA) {
+	pi.Palette = append(pi.Palette[:len(pi.Palette):len(pi.Palette)], color.Transparent)
+	t := uint8(len(pi.Palette) - 1)
+	b := pi.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if src.RGBAAt(x, y).A < 0x80 {
+				pi.SetColorIndex(x, y, t)
+			}
+		}
+	}
+}
+
+// decodeStill decodes the image, for animations nil is returned
+// so they are served as is, unless first frame is requested
+func decodeStill(file, format string, first bool) (image.Image, error) {
+	f, err := os.Open(mediaFile(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if format == "gif" {
+		g, err := gif.DecodeAll(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %v: %v", file, err)
+		}
+		if len(g.Image) == 0 || (len(g.Image) > 1 && !first) {
+			return nil, nil
+		}
+		return g.Image[0], nil
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %v: %v", file, err)
+	}
+	return img, nil
+}
+
+// writeVariant writes the variant to a temp file and renames it in place
+func writeVariant(file, variant string, enc func(*os.File) error) error {
+	fn := variantFile(file, variant)
+	err := os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create cache dir: %v", err)
+	}
+	// the cache is in the site directory, keep it out of git
+	gi := filepath.Join(*rootDir, *cacheDir, ".gitignore")
+	if _, err := os.Stat(gi); err != nil {
+		err = os.WriteFile(gi, []byte("*\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write %v: %v", gi, err)
+		}
+	}
+	f, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create %v: %v", fn, err)
+	}
+	err = enc(f)
+	f.Close()
+	if err != nil {
+		os.Remove(fn + ".tmp")
+		return fmt.Errorf("unable to encode %v: %v", fn, err)
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// dropVariants removes cached variants of a deleted or renamed media file
+func dropVariants(file string) {
+	d, err := os.ReadDir(filepath.Join(*rootDir, *cacheDir))
+	if err != nil {
+		return
+	}
+	for _, v := range d {
+		if !v.IsDir() {
+			continue
+		}
+		os.Remove(variantFile(file, v.Name()))
+	}
+}
+
+// responsiveImage points post images under /media/ to a variant of the theme width
+// with a srcset of all available sizes for modern browsers
+func responsiveImage(img *ast.Image) {
+	dst := string(img.Destination)
+	if *imgWidth <= 0 || !strings.HasPrefix(dst, "/media/") || strings.Contains(dst, "?") {
+		return
+	}
+	file := path.Base(unescapeOrEmpty(dst))
+	cfg, _, err := imageConfig(file)
+	if err != nil || cfg.Width <= *imgWidth {
+		return
+	}
+	set := []string{}
+	for _, w := range imageWidths() {
+		if w < cfg.Width {
+			set = append(set, dst+"?w="+strconv.Itoa(w)+" "+strconv.Itoa(w)+"w")
+		}
+	}
+	set = append(set, dst+" "+strconv.Itoa(cfg.Width)+"w")
+	img.Destination = []byte(dst + "?w=" + strconv.Itoa(*imgWidth))
+	if img.Attribute == nil {
+		img.Attribute = &ast.Attribute{}
+	}
+	if img.Attrs == nil {
+		img.Attrs = map[string][]byte{}
+	}
+	img.Attrs["srcset"] = []byte(strings.Join(set, ", "))
+	img.Attrs["sizes"] = []byte(fmt.Sprintf("(max-width: %vpx) 100vw, %vpx", *imgWidth, *imgWidth))
+}
@@ -0,0 +1,146 @@
+// roles limit what admin users can do, from the most to the least privileged:
+// admins manage users and settings, editors publish anything,
+// authors edit only their own posts and contributors only create drafts
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	roleAdmin       = "admin"
+	roleEditor      = "editor"
+	roleAuthor      = "author"
+	roleContributor = "contributor"
+)
+
+var (
+	roles        = []string{roleAdmin, roleEditor, roleAuthor, roleContributor}
+	roleLevel    = map[string]int{roleAdmin: 4, roleEditor: 3, roleAuthor: 2, roleContributor: 1}
+	errForbidden = errors.New("permission denied")
+
+	// minimum role required to access admin tabs
+	tabRole = map[string]string{
+		"posts":     roleContributor,
+		"":          roleContributor,
+		"media":     roleContributor,
+		"account":   roleContributor,
+		"redirects": roleEditor,
+		"git":       roleEditor,
+		"users":     roleAdmin,
+		"lockouts":  roleAdmin,
+	}
+)
+
+func validRole(role string) bool {
+	_, ok := roleLevel[role]
+	return ok
+}
+
+// atLeast reports whether role is the same or more privileged than min
+func atLeast(role, min string) bool {
+	return roleLevel[role] >= roleLevel[min]
+}
+
+// role returns role of the user, users created before roles existed are admins
+func (c creds) role(user string) string {
+	us, err := c.load(user)
+	if err != nil {
+		return ""
+	}
+	return us.role()
+}
+
+func (us userSecret) role() string {
+	if us.Role == "" {
+		return roleAdmin
+	}
+	return us.Role
+}
+
+// lastAdmin reports whether user is the only admin left, nobody could manage users without them
+func (c creds) lastAdmin(user string) bool {
+	if c.role(user) != roleAdmin {
+		return false
+	}
+	for _, k := range secretsStore.Keys() {
+		u, ok := strings.CutPrefix(k, adminPrefix)
+		if ok && u != user && c.role(u) == roleAdmin {
+			return false
+		}
+	}
+	return true
+}
+
+func (c creds) setRole(user, role string) error {
+	if !validRole(role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	if role != roleAdmin && c.lastAdmin(user) {
+		return fmt.Errorf("%q is the last admin", user)
+	}
+	us, err := c.load(user)
+	if err != nil {
+		return fmt.Errorf("unable to load user %q: %v", user, err)
+	}
+	us.Role = role
+	return c.store(user, us)
+}
+
+func roleOptions(sel string) string {
+	buf := strings.Builder{}
+	for _, r := range roles {
+		buf.WriteString("<OPTION VALUE=\"" + r + "\"" + map[bool]string{true: " SELECTED", false: ""}[r == sel] + ">" + r + "</OPTION>")
+	}
+	return buf.String()
+}
+
+func tabAllowed(role, tab string) bool {
+	min, ok := tabRole[tab]
+	return ok && atLeast(role, min)
+}
+
+// mayEdit checks if the user can modify an existing post
+// authors and contributors can only modify their own posts, contributors only drafts
+// the author is taken from the file on disk, not from the index or the submitted text
+func (p post) mayEdit(file string) error {
+	if atLeast(p.role, roleEditor) {
+		return nil
+	}
+	file = path.Base(unescapeOrEmpty(file))
+	data, err := os.ReadFile(path.Join(*rootDir, *postsDir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m := postMeta(file, data)
+	if m.author != p.user {
+		return fmt.Errorf("%w: %v can only modify own posts", errForbidden, p.role)
+	}
+	if p.role == roleContributor && !m.published.IsZero() {
+		return fmt.Errorf("%w: contributor can't modify published posts", errForbidden)
+	}
+	return nil
+}
+
+// mayPublish checks if the user can save the post text
+// below editor the text must keep the user as author, so posts can't be handed to someone else
+func (p post) mayPublish(postText string) error {
+	if atLeast(p.role, roleEditor) {
+		return nil
+	}
+	m := postMeta("", []byte(postText))
+	if m.author != p.user {
+		return fmt.Errorf("%w: %v can't set author to %q", errForbidden, p.role, m.author)
+	}
+	if p.role == roleContributor && !m.published.IsZero() {
+		return fmt.Errorf("%w: contributor can only save drafts", errForbidden)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// admin sessions are kept in memory and referenced by a signed cookie
+// the signing key is kept in the secrets store
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "bloki_session"
+	sessionKey    = "bloki:session_key"
+)
+
+type session struct {
+	user     string
+	csrf     string
+	created  time.Time
+	lastSeen time.Time
+}
+
+type sessionStore struct {
+	sessions map[string]*session
+	key      []byte
+
+	sync.Mutex
+}
+
+// signKey loads or creates the cookie signing key, must be called with the lock held
+func (s *sessionStore) signKey() ([]byte, error) {
+	if s.key != nil {
+		return s.key, nil
+	}
+	if secretsStore == nil {
+		return nil, errors.New("unable to access secret store")
+	}
+	k, err := secretsStore.Get(context.TODO(), sessionKey)
+	if err == nil && len(k) >= 32 {
+		s.key = k
+		return s.key, nil
+	}
+	k = make([]byte, 32)
+	_, err = rand.Read(k)
+	if err != nil {
+		return nil, err
+	}
+	err = secretsStore.Put(context.TODO(), sessionKey, k)
+	if err != nil {
+		return nil, err
+	}
+	log.Print("sessions: created new signing key")
+	s.key = k
+	return s.key, nil
+}
+
+func (s *sessionStore) sign(id string) (string, error) {
+	k, err := s.signKey()
+	if err != nil {
+		return "", err
+	}
+	m := hmac.New(sha256.New, k)
+	m.Write([]byte(id))
+	return hex.EncodeToString(m.Sum(nil)), nil
+}
+
+func (s *sessionStore) expired(ss *session) bool {
+	return time.Since(ss.lastSeen) > *sessIdle || time.Since(ss.created) > *sessLife
+}
+
+// create starts a new session for the user and sets the cookie
+func (s *sessionStore) create(w http.ResponseWriter, r *http.Request, user string) error {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+	s.Lock()
+	defer s.Unlock()
+	sig, err := s.sign(id)
+	if err != nil {
+		return err
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	for i, ss := range s.sessions {
+		if s.expired(ss) {
+			delete(s.sessions, i)
+		}
+	}
+	_, err = rand.Read(b)
+	if err != nil {
+		return err
+	}
+	s.sessions[id] = &session{user: user, csrf: hex.EncodeToString(b), created: time.Now(), lastSeen: time.Now()}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id + "." + sig,
+		Path:     *adminUri,
+		MaxAge:   int(sessLife.Seconds()),
+		Secure:   secureRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Printf("sessions: started session for %q from %q", user, r.RemoteAddr)
+	return nil
+}
+
+// user returns the user of a valid session cookie and refreshes the idle timer
+func (s *sessionStore) user(r *http.Request) (string, bool) {
+	ss, ok := s.get(r)
+	if !ok {
+		return "", false
+	}
+	return ss.user, true
+}
+
+func (s *sessionStore) get(r *http.Request) (*session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	id, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return nil, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	exp, err := s.sign(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(sig), []byte(exp)) != 1 {
+		return nil, false
+	}
+	ss, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if s.expired(ss) {
+		delete(s.sessions, id)
+		log.Printf("sessions: session for %q expired", ss.user)
+		return nil, false
+	}
+	ss.lastSeen = time.Now()
+	return ss, true
+}
+
+// logout revokes the current session and clears the cookie
+func (s *sessionStore) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		id, _, _ := strings.Cut(c.Value, ".")
+		s.Lock()
+		if ss, ok := s.sessions[id]; ok {
+			log.Printf("sessions: %q logged out", ss.user)
+		}
+		delete(s.sessions, id)
+		s.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     *adminUri,
+		MaxAge:   -1,
+		Secure:   secureRequest(r),
+		HttpOnly: true,
+	})
+}
+
+// secureRequest tells if the client uses https, directly, per -site_url or via a trusted tls terminating proxy
+func secureRequest(r *http.Request) bool {
+	if r.TLS != nil || strings.HasPrefix(strings.ToLower(*siteUrl), "https://") {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return trustedProxy(ip) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// revoke terminates all sessions of the user
+func (s *sessionStore) revoke(user string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for i, ss := range s.sessions {
+		if ss.user != user {
+			continue
+		}
+		delete(s.sessions, i)
+		n++
+	}
+	log.Printf("sessions: revoked %v sessions of %q", n, user)
+	return n
+}
+
+func (s *sessionStore) count(user string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, ss := range s.sessions {
+		if ss.user == user && !s.expired(ss) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,241 @@
+// text mode renders pages as wrapped plain text for lynx, curl and other terminal clients
+// links are numbered like [1] and listed as references at the bottom of the page
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+var (
+	textBrowsers  = []string{"Lynx", "Links", "ELinks", "w3m", "curl"}
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTagRe     = regexp.MustCompile(`<[^>]*>`)
+	htmlBrRe      = regexp.MustCompile(`(?i)^<br\s*/?>$`)
+)
+
+func textBrowser(ua string) bool {
+	for _, b := range textBrowsers {
+		if strings.HasPrefix(ua, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// pageTemplate returns the template for the client, text if requested with ?format=txt
+func pageTemplate(r *http.Request) string {
+	if r.FormValue("format") == "txt" {
+		return "text"
+	}
+	return vintage(r.UserAgent())
+}
+
+// textRefs numbers links of a text page
+type textRefs struct {
+	base   string // local links are made absolute with the site url
+	format bool   // text mode was requested with ?format=txt, keep it on local links
+	gopher string // host:port of the gopher server, local links of gopher posts without site url
+	urls   []string
+}
+
+// ref returns number of the link, empty for local links a gopher client can't follow
+func (l *textRefs) ref(u string) string {
+	if strings.HasPrefix(u, "/") && l.gopher != "" {
+		u = gopherUrl(l.gopher, u)
+		if u == "" {
+			return ""
+		}
+	}
+	if strings.HasPrefix(u, "/") {
+		if l.format && !strings.HasPrefix(u, "/media/") {
+			sep := "?"
+			if strings.Contains(u, "?") {
+				sep = "&"
+			}
+			u += sep + "format=txt"
+		}
+		u = l.base + u
+	}
+	for i, x := range l.urls {
+		if x == u {
+			return fmt.Sprintf("[%d]", i+1)
+		}
+	}
+	l.urls = append(l.urls, u)
+	return fmt.Sprintf("[%d]", len(l.urls))
+}
+
+func (l *textRefs) list() string {
+	buf := strings.Builder{}
+	for i, u := range l.urls {
+		fmt.Fprintf(&buf, "%4v %v\n", fmt.Sprintf("[%d]", i+1), u)
+	}
+	return buf.String()
+}
+
+// wrapText word wraps s to -text_width, line breaks in s are kept
+func wrapText(s, first, indent string) string {
+	buf := strings.Builder{}
+	pfx := first
+	for _, ln := range strings.Split(s, "\n") {
+		cur := pfx
+		for _, w := range strings.Fields(ln) {
+			if cur != pfx && utf8.RuneCountInString(cur)+1+utf8.RuneCountInString(w) > *txtWidth {
+				buf.WriteString(cur + "\n")
+				cur = indent
+			}
+			if cur != pfx && cur != indent {
+				cur += " "
+			}
+			cur += w
+		}
+		buf.WriteString(strings.TrimRight(cur, " ") + "\n")
+		pfx = indent
+	}
+	return buf.String()
+}
+
+// inline renders text of a paragraph, heading or table cell
+func (l *textRefs) inline(n ast.Node) string {
+	buf := strings.Builder{}
+	ast.WalkFunc(n, func(c ast.Node, entering bool) ast.WalkStatus {
+		switch c := c.(type) {
+		case *ast.Text:
+			buf.WriteString(strings.ReplaceAll(string(c.Literal), "\n", " "))
+		case *ast.Code:
+			buf.Write(c.Literal)
+		case *ast.Softbreak:
+			buf.WriteString(" ")
+		case *ast.Hardbreak:
+			buf.WriteString("\n")
+		case *ast.HTMLSpan:
+			if htmlBrRe.Match(c.Literal) {
+				buf.WriteString("\n")
+			}
+		case *ast.Link:
+			// red wiki links lead to the admin, there is nothing to follow yet
+			if !entering && !strings.HasPrefix(string(c.Destination), *adminUri) {
+				buf.WriteString(l.ref(string(c.Destination)))
+			}
+		case *ast.Image:
+			if entering {
+				buf.WriteString("[image: ")
+				break
+			}
+			buf.WriteString("]" + l.ref(string(c.Destination)))
+		}
+		return ast.GoToNext
+	})
+	return html.UnescapeString(buf.String())
+}
+
+// render renders post markdown as text, the title is linked to name and followed by the byline
+func (l *textRefs) render(md []byte, name, byline string) string {
+	p := parser.NewWithExtensions(parser.CommonExtensions | parser.Autolink)
+	if *wikiMode {
+		p.RegisterInline('[', wikiLink(p.RegisterInline('[', nil)))
+	}
+	buf := strings.Builder{}
+	var block func(n ast.Node, first, indent string)
+	children := func(n ast.Node, first, indent string) {
+		for i, c := range n.GetChildren() {
+			if i == 0 {
+				block(c, first, indent)
+				continue
+			}
+			block(c, indent, indent)
+		}
+	}
+	block = func(n ast.Node, first, indent string) {
+		switch n := n.(type) {
+		case *ast.Heading:
+			t := l.inline(n)
+			switch n.Level {
+			case 1:
+				t += " " + l.ref(name)
+				buf.WriteString(t + "\n" + strings.Repeat("=", utf8.RuneCountInString(t)) + "\n")
+				buf.WriteString(wrapText(byline, "", ""))
+			case 2:
+				buf.WriteString(t + "\n" + strings.Repeat("-", utf8.RuneCountInString(t)) + "\n")
+			default:
+				buf.WriteString(t + "\n")
+			}
+			buf.WriteString("\n")
+		case *ast.Paragraph:
+			buf.WriteString(wrapText(strings.Trim(l.inline(n), "\n"), first, indent))
+			if ls, ok := n.Parent.GetParent().(*ast.List); !ok || !ls.Tight {
+				buf.WriteString("\n")
+			}
+		case *ast.List:
+			num := n.Start
+			if num == 0 {
+				num = 1
+			}
+			for i, c := range n.Children {
+				mark := "* "
+				if n.ListFlags&ast.ListTypeOrdered != 0 {
+					mark = fmt.Sprintf("%d. ", num+i)
+				}
+				pfx := first
+				if i > 0 {
+					pfx = indent
+				}
+				children(c, pfx+mark, indent+strings.Repeat(" ", len(mark)))
+			}
+			if _, ok := n.Parent.(*ast.ListItem); !ok {
+				buf.WriteString("\n")
+			}
+		case *ast.BlockQuote:
+			children(n, first+"> ", indent+"> ")
+		case *ast.CodeBlock:
+			pfx := first
+			for _, ln := range strings.Split(strings.TrimRight(string(n.Literal), "\n"), "\n") {
+				buf.WriteString(pfx + "    " + ln + "\n")
+				pfx = indent
+			}
+			buf.WriteString("\n")
+		case *ast.HorizontalRule:
+			buf.WriteString(strings.Repeat("-", *txtWidth) + "\n\n")
+		case *ast.HTMLBlock:
+			t := htmlTagRe.ReplaceAllString(htmlCommentRe.ReplaceAllString(string(n.Literal), ""), "")
+			if strings.TrimSpace(t) != "" {
+				buf.WriteString(wrapText(html.UnescapeString(t), first, indent) + "\n")
+			}
+		case *ast.TableRow:
+			cl := []string{}
+			for _, c := range n.Children {
+				cl = append(cl, l.inline(c))
+			}
+			buf.WriteString(wrapText(strings.Join(cl, " | "), first, indent))
+		case *ast.Table:
+			children(n, first, indent)
+			buf.WriteString("\n")
+		default:
+			children(n, first, indent)
+		}
+	}
+	block(p.Parse(md), "", "")
+	return buf.String()
+}
+
+// textPager renders home, newer and older posts navigation and search hint of text pages
+func (t *TemplateData) textPager() {
+	nav := []string{"Home " + t.refs.ref("/")}
+	if t.Page > 0 {
+		nav = append(nav, "Newer Posts "+t.refs.ref(fmt.Sprintf("%v?pg=%v", t.PgUrl, t.PgNewer)))
+	}
+	if t.Page < t.PgOldest {
+		nav = append(nav, "Older Posts "+t.refs.ref(fmt.Sprintf("%v?pg=%v", t.PgUrl, t.PgOlder)))
+	}
+	t.Paginator = strings.Join(nav, " | ") + "\n"
+	t.Paginator += "Search: " + t.refs.base + "/?query=<words>" + map[bool]string{true: "&format=txt"}[t.refs.format] + "\n"
+	t.References = t.refs.list()
+}
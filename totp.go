@@ -0,0 +1,270 @@
+// totp implements rfc 6238 time based one time passwords for admin two factor authentication
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const (
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1
+	totpRecovery  = 10
+	totpSecretLen = 20
+)
+
+var totpEnc = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	m := hmac.New(sha1.New, secret)
+	m.Write(msg)
+	sum := m.Sum(nil)
+	o := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[o:o+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%uint32(math.Pow10(totpDigits)))
+}
+
+func totpUri(user, secret string) string {
+	issuer := "BloKi " + *siteName
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+user) +
+		"?secret=" + secret +
+		"&issuer=" + url.QueryEscape(issuer) +
+		"&algorithm=SHA1&digits=" + fmt.Sprint(totpDigits) +
+		"&period=" + fmt.Sprint(totpPeriod)
+}
+
+// totpQr returns otpauth uri as png qr code in a data uri, ready for img src
+func totpQr(uri string) string {
+	c, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return ""
+	}
+	c.Scale = 4
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(c.PNG())
+}
+
+func recoveryHash(code string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code)))))
+}
+
+func (c creds) hasTotp(user string) bool {
+	us, err := c.load(user)
+	return err == nil && us.Totp != ""
+}
+
+// totpMatch returns the time step a code is valid for
+func totpMatch(secret, code string) (int64, bool) {
+	sec, err := totpEnc.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for s := now - totpSkew; s <= now+totpSkew; s++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(sec, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpEnable generates a new pending totp secret and recovery codes for the user, an existing
+// secret keeps working until the new one is confirmed with totpConfirm, so a failed scan can't lock the user out
+// returns the otpauth uri and plain text recovery codes, which are only stored hashed
+func (c creds) totpEnable(user string) (string, []string, error) {
+	us, err := c.load(user)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to load user %q: %v", user, err)
+	}
+	sec := make([]byte, totpSecretLen)
+	_, err = rand.Read(sec)
+	if err != nil {
+		return "", nil, err
+	}
+	us.TotpNew = totpEnc.EncodeToString(sec)
+	us.RecoveryNew = nil
+	codes := []string{}
+	for i := 0; i < totpRecovery; i++ {
+		b := make([]byte, 5)
+		_, err = rand.Read(b)
+		if err != nil {
+			return "", nil, err
+		}
+		rc := fmt.Sprintf("%x", b)
+		codes = append(codes, rc)
+		us.RecoveryNew = append(us.RecoveryNew, recoveryHash(rc))
+	}
+	err = c.store(user, us)
+	if err != nil {
+		return "", nil, err
+	}
+	return totpUri(user, us.TotpNew), codes, nil
+}
+
+// totpConfirm activates the pending secret once a code from the authenticator app matches it
+func (c creds) totpConfirm(user, code string) error {
+	us, err := c.load(user)
+	if err != nil {
+		return fmt.Errorf("unable to load user %q: %v", user, err)
+	}
+	if us.TotpNew == "" {
+		return errors.New("no pending two factor setup")
+	}
+	s, ok := totpMatch(us.TotpNew, strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+	if !ok {
+		return errors.New("invalid two factor code")
+	}
+	us.Totp, us.TotpStep, us.Recovery = us.TotpNew, s, us.RecoveryNew
+	us.TotpNew, us.RecoveryNew = "", nil
+	return c.store(user, us)
+}
+
+func (c creds) totpDisable(user string) error {
+	us, err := c.load(user)
+	if err != nil {
+		return fmt.Errorf("unable to load user %q: %v", user, err)
+	}
+	us.Totp = ""
+	us.TotpStep = 0
+	us.Recovery = nil
+	us.TotpNew = ""
+	us.RecoveryNew = nil
+	return c.store(user, us)
+}
+
+// totpCheck verifies the second factor, users without totp always pass
+// each code and recovery code can only be used once
+func (c creds) totpCheck(user, code string) error {
+	us, err := c.load(user)
+	if err != nil {
+		return err
+	}
+	if us.Totp == "" {
+		return nil
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return errors.New("two factor code required")
+	}
+	if s, ok := totpMatch(us.Totp, code); ok {
+		if s <= us.TotpStep {
+			return errors.New("two factor code already used")
+		}
+		us.TotpStep = s
+		return c.store(user, us)
+	}
+	h := recoveryHash(code)
+	for i, rc := range us.Recovery {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) != 1 {
+			continue
+		}
+		us.Recovery = append(us.Recovery[:i], us.Recovery[i+1:]...)
+		return c.store(user, us)
+	}
+	return errors.New("invalid two factor code")
+}
+
+// account lets users set up two factor authentication for themselves
+type account struct{ user string }
+
+func (a account) page(msg string) (string, error) {
+	if msg != "" {
+		msg = msg + "<P>\n"
+	}
+	cr := creds{}
+	us, err := cr.load(a.user)
+	if err != nil {
+		return "", fmt.Errorf("unable to load user %q: %v", a.user, err)
+	}
+	buf := strings.Builder{}
+	buf.WriteString(`<H1>Account - ` + html.EscapeString(a.user) + `</H1>
+	` + msg + `
+	<INPUT TYPE="HIDDEN" NAME="tab" VALUE="account">
+	`)
+	switch {
+	case us.TotpNew != "":
+		uri := totpUri(a.user, us.TotpNew)
+		buf.WriteString(`Scan the QR code with an authenticator app or enter the URI manually, then enter the code
+		it shows to finish the setup. Until then 2FA is not changed.<P>
+		<IMG SRC="` + totpQr(uri) + `" ALT="QR Code"><P>
+		<TT>` + html.EscapeString(uri) + `</TT><P>
+		Code: <INPUT TYPE="TEXT" NAME="otp" SIZE="10" AUTOCOMPLETE="one-time-code">
+		<INPUT TYPE="SUBMIT" NAME="verify" VALUE="Confirm 2FA">
+		<INPUT TYPE="SUBMIT" NAME="cancel" VALUE="Cancel">
+		`)
+	case us.Totp != "":
+		buf.WriteString(`Two factor authentication is enabled, ` + fmt.Sprint(len(us.Recovery)) + ` recovery codes left.<P>
+		<INPUT TYPE="SUBMIT" NAME="totp" VALUE="Replace 2FA" ONCLICK="return confirm('This will create a new 2FA secret and recovery codes, the current ones work until the new secret is confirmed. Continue?');">
+		<INPUT TYPE="SUBMIT" NAME="totp" VALUE="Disable 2FA" ONCLICK="this.value=confirm('Are you sure you want to disable 2FA?');">
+		`)
+	default:
+		buf.WriteString(`Two factor authentication is not enabled.<P>
+		<INPUT TYPE="SUBMIT" NAME="totp" VALUE="Enable 2FA">
+		`)
+	}
+	return buf.String(), nil
+}
+
+func (a account) totp(action string) (string, error) {
+	cr := creds{}
+	switch action {
+	case "Enable 2FA", "Replace 2FA":
+		_, codes, err := cr.totpEnable(a.user)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("User %q started 2FA setup", a.user)
+		return a.page("Recovery codes, each can be used once instead of the 2FA code. Write them down, they will not be shown again:<P>\n" +
+			"<TT>" + strings.Join(codes, "<BR>\n") + "</TT>")
+	case "true":
+		err := cr.totpDisable(a.user)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("User %q disabled 2FA", a.user)
+		return a.page("Disabled 2FA.")
+	}
+	return a.page("")
+}
+
+func (a account) verify(code string) (string, error) {
+	err := creds{}.totpConfirm(a.user, code)
+	if err != nil {
+		return a.page(html.EscapeString(err.Error()) + ", try again.")
+	}
+	log.Printf("User %q enabled 2FA", a.user)
+	return a.page("Enabled 2FA, it will be required on the next login.")
+}
+
+// cancel drops a pending 2FA setup, an enabled secret stays
+func (a account) cancel() (string, error) {
+	cr := creds{}
+	us, err := cr.load(a.user)
+	if err != nil {
+		return "", err
+	}
+	us.TotpNew, us.RecoveryNew = "", nil
+	err = cr.store(a.user, us)
+	if err != nil {
+		return "", err
+	}
+	return a.page("")
+}
@@ -0,0 +1,77 @@
+// wiki mode resolves [[Page Name]] and [[Page Name|label]] links to posts by title or file name
+// links to pages that don't exist yet are rendered red and lead to the admin to create them
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+func wikiFile(page string) string {
+	return strings.ReplaceAll(strings.TrimSpace(page), " ", "_") + ".md"
+}
+
+func wikiTitle(file string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(file, ".md"), "_", " ")
+}
+
+// page finds post by wiki page name, title is matched case insensitive
+// drafts and scheduled posts are found but not visible
+func (idx *postIndex) page(name string) (file string, visible bool, ok bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	f, ok := idx.titled(name)
+	if !ok || !idx.metaData[f].visible() {
+		if m, found := idx.metaData[wikiFile(name)]; found && (m.visible() || !ok) {
+			f, ok = wikiFile(name), true
+		}
+	}
+	if !ok {
+		return "", false, false
+	}
+	return f, idx.metaData[f].visible(), true
+}
+
+func wikiLink(prev parser.InlineParser) parser.InlineParser {
+	return func(p *parser.Parser, data []byte, offset int) (int, ast.Node) {
+		d := data[offset:]
+		if !bytes.HasPrefix(d, []byte("[[")) {
+			return prev(p, data, offset)
+		}
+		end := bytes.Index(d, []byte("]]"))
+		if end == -1 || bytes.IndexByte(d[:end], '\n') != -1 {
+			return prev(p, data, offset)
+		}
+		target, label, ok := strings.Cut(string(d[2:end]), "|")
+		target = strings.TrimSpace(target)
+		if !ok {
+			label = target
+		}
+		if target == "" {
+			return prev(p, data, offset)
+		}
+		l := &ast.Link{}
+		f, vis, ok := idx.page(target)
+		switch {
+		case vis:
+			idx.RLock()
+			l.Destination = []byte("/" + idx.metaData[f].url)
+			idx.RUnlock()
+		case ok:
+			// drafts are not found by visitors, the red link leads to editing the draft
+			l.Destination = []byte(*adminUri + "?tab=posts&edit=Edit&filename=" + url.QueryEscape(f))
+			l.Title = []byte("Draft page " + target)
+			l.AdditionalAttributes = []string{`class="redlink"`, `style="color: red;"`}
+		default:
+			l.Destination = []byte(*adminUri + "?tab=posts&create=" + url.QueryEscape(wikiFile(target)))
+			l.Title = []byte("Create page " + target)
+			l.AdditionalAttributes = []string{`class="redlink"`, `style="color: red;"`}
+		}
+		ast.AppendChild(l, &ast.Text{Leaf: ast.Leaf{Literal: []byte(strings.TrimSpace(label))}})
+		return end + 2, l
+	}
+}